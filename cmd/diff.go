@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/fswatch"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
+)
+
+// diffSigns prefix each kind of difference in the human readable output.
+var diffSigns = map[string]string{
+	fswatch.SourceOnly: "+",
+	fswatch.BackupOnly: "-",
+	fswatch.Changed:    "~",
+}
+
+// diff prints the files only in the source, only in the backup and those whose
+// content differs, for every watched path or the ones given.
+func diff(args []string) error {
+	var asJSON bool
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.StringVar(&config.File, "c", "/etc/watchgo/config.yml", "examples --c=config.yml")
+	fs.BoolVar(&asJSON, "json", false, "print the differences as json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [-c config.yml] [--json] [watched path...]\n\n", config.AppName)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if err := config.LoadConfig(config.File); err != nil {
+		return err
+	}
+	logger.SetGlobalLogger(logger.New())
+
+	// recorded sums spare reading the files and tell the compressed backups, a copy
+	// of the manifest is read while the daemon holds it
+	if err := manifest.OpenReadOnly(config.ManifestFile()); err != nil {
+		fmt.Fprintf(os.Stderr, "manifest: %s\n", err)
+	}
+	defer manifest.Close()
+	if !manifest.Opened() {
+		fmt.Fprintln(os.Stderr, "no manifest: comparing which files exist, not their content")
+	}
+
+	indexes, err := diffPaths(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	// the differences found are printed even when some files could not be read
+	var (
+		all     []fswatch.Difference
+		diffErr error
+	)
+	for _, i := range indexes {
+		list, err := fswatch.Diff(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", config.FileSystemCfg.Paths[i].Path, err)
+			if diffErr == nil {
+				diffErr = err
+			}
+		}
+		all = append(all, list...)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if all == nil {
+			all = []fswatch.Difference{}
+		}
+		if err := enc.Encode(all); err != nil {
+			return err
+		}
+	} else {
+		for _, d := range all {
+			switch d.Kind {
+			case fswatch.BackupOnly:
+				fmt.Printf("%s %s\n", diffSigns[d.Kind], d.Backup)
+			default:
+				fmt.Printf("%s %s\n", diffSigns[d.Kind], d.Source)
+			}
+		}
+	}
+
+	if diffErr != nil {
+		return diffErr
+	}
+	if len(all) > 0 {
+		return fmt.Errorf("%d differences", len(all))
+	}
+	return nil
+}
+
+// diffPaths returns the index of the watched paths named by args, every one without args.
+func diffPaths(args []string) ([]int, error) {
+	var indexes []int
+	if len(args) == 0 {
+		for i := range config.FileSystemCfg.Paths {
+			indexes = append(indexes, i)
+		}
+		return indexes, nil
+	}
+
+	for _, arg := range args {
+		name, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for i, p := range config.FileSystemCfg.Paths {
+			if p.Path == name || p.Namespace() == arg {
+				indexes, found = append(indexes, i), true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not a watched path", arg)
+		}
+	}
+	return indexes, nil
+}
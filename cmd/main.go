@@ -8,6 +8,7 @@ import (
 	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/fswatch"
 	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
 	"log"
 	"os"
 )
@@ -20,14 +21,32 @@ var (
 	docs    string
 )
 
+// commands run instead of the watcher when named by the first argument.
+var commands = map[string]func(args []string) error{
+	"diff":     diff,
+	"restore":  restore,
+	"verify":   verify,
+	"versions": versions,
+}
+
 func init() {
 	if len(os.Args) == 2 && (os.Args[1] == "--version" || os.Args[1] == "-v" || os.Args[1] == "ver") {
 		printVersion()
 		os.Exit(0)
 	}
 
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %s\n", os.Args[1], err)
+			}
+			os.Exit(0)
+		}
+	}
+
 	flag.BoolVar(&config.Debug, "debug", false, "examples --debug=true")
 	flag.StringVar(&config.File, "c", "/etc/watchgo/config.yml", "examples --c=config.yml")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "log the copies, folders and compressions without doing them, examples --dry-run=true")
 	flag.Parse()
 
 	// print help
@@ -77,6 +96,14 @@ func main() {
 	done := make(chan struct{}, 1)
 	defer close(done)
 
+	openManifest := manifest.Open
+	if config.DryRun {
+		openManifest = manifest.OpenReadOnly
+	}
+	if err := openManifest(config.ManifestFile()); err != nil {
+		logger.Fatal().Err(err).Msg("open manifest")
+	}
+
 	fswatch.NewEvent(ctx).Run(c)
 
 	watcher := &fswatch.FSWatcher{Events: watch.Events}
@@ -93,7 +120,7 @@ func main() {
 				watch.Close()
 				return
 			case ev := <-watch.Events:
-				c <- ev
+				watcher.Track(ev, c)
 			}
 		}
 	}()
@@ -102,6 +129,7 @@ func main() {
 	if ok {
 		logger.Info(0).Msg("exit.")
 	}
+	_ = manifest.Close()
 	os.Exit(0)
 }
 
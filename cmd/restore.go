@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
+)
+
+// timeLayouts accepted by the --at flags, a version or snapshot name included.
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15-04-05", "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// restore brings the backups of a file, a directory or a watched path back.
+func restore(args []string) error {
+	var opt core.RestoreOptions
+	var at string
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.StringVar(&config.File, "c", "/etc/watchgo/config.yml", "examples --c=config.yml")
+	fs.StringVar(&opt.To, "to", "", "restore into this folder instead of the original location, examples --to=/tmp/restore")
+	fs.StringVar(&at, "at", "", "restore the state at this time, examples --at=2026-10-18T10:22:00")
+	fs.BoolVar(&opt.Force, "force", false, "overwrite local files newer than the backup")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s restore [-c config.yml] [--to dir] [--at time] [--force] <path>\n\n", config.AppName)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := config.LoadConfig(config.File); err != nil {
+		return err
+	}
+	logger.SetGlobalLogger(logger.New())
+
+	if at != "" {
+		t, err := parseTime(at)
+		if err != nil {
+			return err
+		}
+		opt.At = t
+	}
+	source, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if opt.To != "" {
+		if opt.To, err = filepath.Abs(opt.To); err != nil {
+			return err
+		}
+	}
+
+	// backup times and source times come from the manifest, a copy of it while the
+	// daemon holds it
+	if err := manifest.OpenReadOnly(config.ManifestFile()); err != nil {
+		fmt.Fprintf(os.Stderr, "manifest: %s, using modification times\n", err)
+	}
+	defer manifest.Close()
+
+	list, err := core.NewFileReader(core.NewBuilder()).Restore(source, opt)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Dest < list[j].Dest })
+	var skipped int
+	for _, r := range list {
+		if r.Skipped == core.UpToDate {
+			continue
+		}
+		if r.Skipped != "" {
+			skipped++
+			fmt.Printf("skip     %s: %s\n", r.Dest, r.Skipped)
+			continue
+		}
+		fmt.Printf("restore  %s <- %s\n", r.Dest, r.Backup)
+	}
+	if skipped > 0 {
+		return fmt.Errorf("%d of %d files not restored", skipped, len(list))
+	}
+	return nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
+	"github.com/hinha/watchgo/utils"
+)
+
+// verify scrubs the backup drives for missing, corrupted and unexpected files. While
+// the daemon runs it checks a copy of the manifest, reporting only.
+func verify(args []string) error {
+	var (
+		opt  core.VerifyOptions
+		list bool
+	)
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.StringVar(&config.File, "c", "/etc/watchgo/config.yml", "examples --c=config.yml")
+	fs.BoolVar(&opt.Restart, "restart", false, "check every backup again instead of resuming an unfinished run")
+	fs.BoolVar(&opt.Repair, "repair", false, "copy corrupted and missing backups again when their source still matches")
+	fs.BoolVar(&list, "unexpected", false, "list the backups missing from the manifest, such as the ones made before it existed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [-c config.yml] [--restart] [--repair] [--unexpected]\n\n", config.AppName)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if err := config.LoadConfig(config.File); err != nil {
+		return err
+	}
+	logger.SetGlobalLogger(logger.New())
+
+	err := manifest.Open(config.ManifestFile())
+	if errors.Is(err, manifest.ErrLocked) {
+		if opt.Repair {
+			return fmt.Errorf("%w, stop the daemon to repair", err)
+		}
+		err = manifest.OpenReadOnly(config.ManifestFile())
+	}
+	if err != nil {
+		return err
+	}
+	defer manifest.Close()
+	if manifest.Copied() {
+		fmt.Fprintln(os.Stderr, "the daemon is running: checking a copy of the manifest, nothing is recorded")
+	}
+
+	var problems, repaired, unexpected int
+	opt.Report = func(p core.Problem) {
+		if p.Kind == core.Unexpected {
+			// most likely backed up before the manifest existed
+			unexpected++
+			if list {
+				fmt.Printf("%-10s  %s\n", p.Kind, p.Backup)
+			}
+			return
+		}
+		problems++
+		switch {
+		case p.Repaired:
+			repaired++
+			fmt.Printf("%-10s  %s (repaired)\n", p.Kind, p.Backup)
+		case p.Err != nil:
+			fmt.Printf("%-10s  %s: %s\n", p.Kind, p.Backup, p.Err)
+		default:
+			fmt.Printf("%-10s  %s\n", p.Kind, p.Backup)
+		}
+	}
+	opt.Progress = func(checked int, size int64) {
+		fmt.Fprintf(os.Stderr, "checked %d files, %s\n", checked, utils.ByteSize(size))
+	}
+
+	checked, err := core.NewFileReader(core.NewBuilder()).Verify(opt)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("checked %d files, %d problems, %d repaired, %d not in the manifest\n", checked, problems, repaired, unexpected)
+	if problems > repaired {
+		return fmt.Errorf("%d problems left", problems-repaired)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/utils"
+)
+
+// versions lists the previous backups of a local file.
+func versions(args []string) error {
+	fs := flag.NewFlagSet("versions", flag.ExitOnError)
+	fs.StringVar(&config.File, "c", "/etc/watchgo/config.yml", "examples --c=config.yml")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s versions [-c config.yml] <path>\n\n", config.AppName)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := config.LoadConfig(config.File); err != nil {
+		return err
+	}
+
+	source, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	current, ok := core.BackupOf(source)
+	if !ok {
+		return fmt.Errorf("%s is not below a watched path", source)
+	}
+	list, err := core.Versions(source)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range list {
+		fmt.Printf("%-19s  %10s  %s\n", v.Time.Format("2006-01-02 15:04:05"), utils.ByteSize(v.Size), v.Path)
+	}
+	if fi, err := os.Stat(current); err == nil {
+		fmt.Printf("%-19s  %10s  %s\n", "current", utils.ByteSize(fi.Size()), current)
+	}
+	return nil
+}
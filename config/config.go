@@ -5,50 +5,303 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/hinha/watchgo/rules"
 )
 
 const (
 	AppName            = "watch-go"
 	staticBackupFolder = "Backup Files"
+	// SnapshotsFolder holds the snapshots inside "Backup Files", no path can use it as namespace.
+	SnapshotsFolder = "snapshots"
+	// OptimizedFolder holds the compressed derivatives inside "Backup Files", no path can use it as namespace.
+	OptimizedFolder = "optimized"
+)
+
+// Hash algorithms accepted by FileSystemConfig.Hash.
+const (
+	HashMD5    = "md5"
+	HashSHA256 = "sha256"
+	HashBLAKE3 = "blake3"
+	HashXXH3   = "xxh3"
+)
+
+// Policies applied to the backup of a deleted file, see FileSystemConfig.Backup.OnDelete.
+const (
+	OnDeleteIgnore = "ignore"
+	OnDeleteMirror = "mirror"
+	OnDeleteTrash  = "trash"
 )
 
 var (
 	cfg  config
 	File string
 
-	Debug         bool
+	Debug bool
+	// DryRun logs the copies, folders and compressions instead of doing them.
+	DryRun bool
+
 	General       = &cfg.General
 	FileSystemCfg = &cfg.FileSystem
 )
 
 type config struct {
 	General struct {
-		Worker       int    `yaml:"worker"`
-		WorkerBuffer int    `yaml:"worker_buffer"`
-		EventBuffer  int    `yaml:"event_buffer"`
-		Verbose      bool   `yaml:"verbose"`
-		ErrorLog     string `yaml:"error_log"`
-		InfoLog      string `yaml:"info_log"`
-		PidFile      string `yaml:"pid_file"`
+		Worker       int           `yaml:"worker"`
+		WorkerBuffer int           `yaml:"worker_buffer"`
+		EventBuffer  int           `yaml:"event_buffer"`
+		Debounce     time.Duration `yaml:"debounce"`
+		HashWorker   int           `yaml:"hash_worker"`
+		HashMemory   int           `yaml:"hash_memory"`
+		Verbose      bool          `yaml:"verbose"`
+		ErrorLog     string        `yaml:"error_log"`
+		InfoLog      string        `yaml:"info_log"`
+		PidFile      string        `yaml:"pid_file"`
 	} `yaml:"general"`
 	FileSystem FileSystemConfig `yaml:"file_system"`
 }
 
 type FileSystemConfig struct {
-	Paths       []string       `yaml:"paths"`
+	Paths       []PathConfig   `yaml:"paths"`
 	Compress    CompressConfig `yaml:"compress"`
 	MaxFileSize int64          `yaml:"max_file_size"`
+	Hash        string         `yaml:"hash"`
+	Backup      struct {
+		HardDrivePath  string          `yaml:"hard_drive_path"`
+		Prefix         []string        `yaml:"prefix"`
+		Types          []string        `yaml:"types"`
+		Ignore         []string        `yaml:"ignore"`
+		OnDelete       string          `yaml:"on_delete"`
+		TrashRetention time.Duration   `yaml:"trash_retention"`
+		Manifest       string          `yaml:"manifest"`
+		Dedup          bool            `yaml:"dedup"`
+		Verify         bool            `yaml:"verify"`
+		Versions       bool            `yaml:"versions"`
+		Retention      RetentionConfig `yaml:"retention"`
+		Snapshot       SnapshotConfig  `yaml:"snapshot"`
+		Preserve       PreserveConfig  `yaml:"preserve"`
+	} `yaml:"backup"`
+}
+
+// PathConfig is one entry of file_system.paths, written either as a plain path or
+// as an object with an id or name naming its folder in the backup drive.
+//
+// Compress, MaxFileSize and Backup override the global file_system values for this
+// path only, fields left out fall back to them.
+type PathConfig struct {
+	Path string `yaml:"path"`
+	ID   string `yaml:"id"`
+	Name string `yaml:"name"`
+
+	Compress    *PathCompressConfig `yaml:"compress"`
+	MaxFileSize *int64              `yaml:"max_file_size"`
 	Backup      struct {
-		HardDrivePath string   `yaml:"hard_drive_path"`
-		Prefix        []string `yaml:"prefix"`
+		HardDrivePath string           `yaml:"hard_drive_path"`
+		Prefix        []string         `yaml:"prefix"`
+		Types         []string         `yaml:"types"`
+		Ignore        []string         `yaml:"ignore"`
+		Retention     *RetentionConfig `yaml:"retention"`
 	} `yaml:"backup"`
 }
 
+func (p *PathConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&p.Path); err == nil {
+		return nil
+	}
+
+	type plain PathConfig
+	return unmarshal((*plain)(p))
+}
+
+// Namespace returns the folder holding the backups of the path: its id, its name
+// or else the last element of the path.
+func (p *PathConfig) Namespace() string {
+	switch {
+	case p.ID != "":
+		return p.ID
+	case p.Name != "":
+		return p.Name
+	}
+	return filepath.Base(p.Path)
+}
+
+// GetCompress returns the compression of the path, the fields its compress block
+// leaves out being the global ones.
+func (p *PathConfig) GetCompress() CompressConfig {
+	c := cfg.FileSystem.Compress
+	if p.Compress == nil {
+		return c
+	}
+	if p.Compress.Enabled != nil {
+		c.Enabled = *p.Compress.Enabled
+	}
+	if p.Compress.Quality != nil {
+		c.Quality = *p.Compress.Quality
+	}
+	if p.Compress.KeepOriginal != nil {
+		c.KeepOriginal = *p.Compress.KeepOriginal
+	}
+	return c
+}
+
+// GetMaxFileSize returns the size limit of the path in megabyte, zero is unlimited.
+func (p *PathConfig) GetMaxFileSize() int64 {
+	if p.MaxFileSize != nil {
+		return *p.MaxFileSize
+	}
+	return cfg.FileSystem.MaxFileSize
+}
+
+// GetPrefix returns the prefix of files to be processed in the path.
+func (p *PathConfig) GetPrefix() []string {
+	if len(p.Backup.Prefix) > 0 {
+		return p.Backup.Prefix
+	}
+	return cfg.FileSystem.Backup.Prefix
+}
+
+// GetTypes returns the media types of the files backed up from the path.
+func (p *PathConfig) GetTypes() []string {
+	if len(p.Backup.Types) > 0 {
+		return p.Backup.Types
+	}
+	return cfg.FileSystem.Backup.Types
+}
+
+// GetIgnore returns the ignore rules of the path, the global ones followed by its own
+// so they decide last.
+func (p *PathConfig) GetIgnore() []string {
+	ignore := make([]string, 0, len(cfg.FileSystem.Backup.Ignore)+len(p.Backup.Ignore))
+	ignore = append(ignore, cfg.FileSystem.Backup.Ignore...)
+	return append(ignore, p.Backup.Ignore...)
+}
+
+// GetHardDrivePath returns the drive the path is backed up into.
+func (p *PathConfig) GetHardDrivePath() string {
+	if p.Backup.HardDrivePath != "" {
+		return p.Backup.HardDrivePath
+	}
+	return cfg.FileSystem.Backup.HardDrivePath
+}
+
+// GetRetention returns the retention of the versions of the path.
+func (p *PathConfig) GetRetention() RetentionConfig {
+	if p.Backup.Retention != nil {
+		return *p.Backup.Retention
+	}
+	return cfg.FileSystem.Backup.Retention
+}
+
+// BackupFolder returns the "Backup Files" folder on the drive of the path.
+func (p *PathConfig) BackupFolder() string {
+	return filepath.Join(p.GetHardDrivePath(), staticBackupFolder)
+}
+
+// Lookup returns the watched path root.
+func (c *FileSystemConfig) Lookup(root string) (*PathConfig, bool) {
+	root = filepath.Clean(root)
+	for i := range c.Paths {
+		if c.Paths[i].Path == root {
+			return &c.Paths[i], true
+		}
+	}
+	return nil, false
+}
+
+// Find returns the watched path containing name.
+func (c *FileSystemConfig) Find(name string) (*PathConfig, bool) {
+	for i := range c.Paths {
+		root := c.Paths[i].Path
+		if name == root || strings.HasPrefix(name, root+string(filepath.Separator)) {
+			return &c.Paths[i], true
+		}
+	}
+	return nil, false
+}
+
+// PreserveConfig selects the file metadata copied along with the content.
+type PreserveConfig struct {
+	// Times modification and access time.
+	Times bool `yaml:"times"`
+	// Mode permission bits, of files and folders.
+	Mode bool `yaml:"mode"`
+	// Owner user and group, only applied when running as root.
+	Owner bool `yaml:"owner"`
+	// Xattrs extended attributes, linux only.
+	Xattrs bool `yaml:"xattrs"`
+}
+
+// RetentionConfig selects the versions of a file kept by the janitor, a version is
+// kept when any of the keep rules holds it. Without keep rules every version is kept,
+// MaxAge still pruning the old ones.
+type RetentionConfig struct {
+	// KeepLast the newest versions.
+	KeepLast int `yaml:"keep_last"`
+	// KeepDaily the newest version of each of the last days with versions.
+	KeepDaily int `yaml:"keep_daily"`
+	// KeepWeekly the newest version of each of the last weeks with versions.
+	KeepWeekly int `yaml:"keep_weekly"`
+	// KeepMonthly the newest version of each of the last months with versions.
+	KeepMonthly int `yaml:"keep_monthly"`
+	// MaxAge versions older than it are pruned even when kept by a rule, zero disables it.
+	MaxAge time.Duration `yaml:"max_age"`
+	// DryRun only logs the versions that would be pruned.
+	DryRun bool `yaml:"dry_run"`
+}
+
+// Enabled reports whether the retention prunes anything.
+func (r RetentionConfig) Enabled() bool {
+	return r.KeepLast > 0 || r.KeepDaily > 0 || r.KeepWeekly > 0 || r.KeepMonthly > 0 || r.MaxAge > 0
+}
+
+func (r RetentionConfig) validate() error {
+	if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 || r.MaxAge < 0 {
+		return fmt.Errorf("retention values must not be negative")
+	}
+	return nil
+}
+
+// validateTypes checks the types rules are written as *, a type or a family.
+func validateTypes(types []string) error {
+	for _, t := range types {
+		if t == "*" || t == "*/*" {
+			continue
+		}
+		parts := strings.Split(t, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" {
+			return fmt.Errorf("invalid type %q, want a type like application/pdf or a family like image/*", t)
+		}
+	}
+	return nil
+}
+
+// SnapshotConfig schedules the snapshots of the watched paths.
+type SnapshotConfig struct {
+	// Interval between two snapshots, zero disables them.
+	Interval time.Duration `yaml:"interval"`
+	// Keep the newest snapshots, zero keeps them all.
+	Keep int `yaml:"keep"`
+}
+
 type CompressConfig struct {
 	Enabled bool `yaml:"enabled"`
 	Quality int  `yaml:"quality"`
+	// KeepOriginal leaves the backup untouched, the compressed image being stored
+	// apart in the optimized tree.
+	KeepOriginal bool `yaml:"keep_original"`
+}
+
+// PathCompressConfig is the compress block of a path, a field left out keeps the
+// global value.
+type PathCompressConfig struct {
+	Enabled      *bool `yaml:"enabled"`
+	Quality      *int  `yaml:"quality"`
+	KeepOriginal *bool `yaml:"keep_original"`
 }
 
 // LoadConfig Read and parse config file.
@@ -69,6 +322,11 @@ func LoadConfig(configFile string) error {
 		log.Printf("[%s] error: %s parse from file %s\n", AppName, err, filename)
 		return err
 	}
+
+	if err = validate(); err != nil {
+		log.Printf("[%s] error: %s invalid config %s\n", AppName, err, filename)
+		return err
+	}
 	log.Printf("load settings √\n")
 	return nil
 }
@@ -87,10 +345,112 @@ func ReloadConfig() error {
 	if err != nil {
 		return fmt.Errorf("[%s] error: %s parse from file %s\n", AppName, err, filename)
 	}
+	if err = validate(); err != nil {
+		return fmt.Errorf("[%s] error: %s invalid config %s\n", AppName, err, filename)
+	}
 	log.Printf("Config file re-load: %s", filename)
 	return nil
 }
 
+// validate checks the loaded values and fills in defaults.
+func validate() error {
+	namespaces := make(map[string]string)
+	for i := range cfg.FileSystem.Paths {
+		p := &cfg.FileSystem.Paths[i]
+		if p.Path == "" {
+			return fmt.Errorf("paths entry %d has no path", i)
+		}
+		p.Path = filepath.Clean(p.Path)
+
+		ns := p.Namespace()
+		if ns == "" || ns == "." || ns == SnapshotsFolder || ns == OptimizedFolder || strings.HasPrefix(ns, ".") || strings.ContainsAny(ns, `/\`) {
+			return fmt.Errorf("path %s has an invalid backup namespace %q", p.Path, ns)
+		}
+		dst := filepath.Join(p.BackupFolder(), ns)
+		if other, ok := namespaces[dst]; ok {
+			return fmt.Errorf("paths %s and %s both back up into %q, set a distinct id or name", other, p.Path, dst)
+		}
+		namespaces[dst] = p.Path
+
+		if r := p.Backup.Retention; r != nil {
+			if err := r.validate(); err != nil {
+				return fmt.Errorf("path %s: %w", p.Path, err)
+			}
+		}
+		if err := validateTypes(p.Backup.Types); err != nil {
+			return fmt.Errorf("path %s: %w", p.Path, err)
+		}
+		if _, err := rules.ParseAll(p.Backup.Ignore, ""); err != nil {
+			return fmt.Errorf("path %s: %w", p.Path, err)
+		}
+	}
+	if err := cfg.FileSystem.Backup.Retention.validate(); err != nil {
+		return err
+	}
+	if err := validateTypes(cfg.FileSystem.Backup.Types); err != nil {
+		return err
+	}
+	if _, err := rules.ParseAll(cfg.FileSystem.Backup.Ignore, ""); err != nil {
+		return err
+	}
+	if s := cfg.FileSystem.Backup.Snapshot; s.Interval < 0 || s.Keep < 0 {
+		return fmt.Errorf("snapshot values must not be negative")
+	}
+
+	if cfg.General.HashWorker <= 0 {
+		cfg.General.HashWorker = runtime.NumCPU()
+	}
+	if cfg.General.HashMemory <= 0 {
+		cfg.General.HashMemory = 64
+	}
+
+	switch cfg.FileSystem.Hash {
+	case "":
+		cfg.FileSystem.Hash = HashMD5
+	case HashMD5, HashSHA256, HashBLAKE3, HashXXH3:
+	default:
+		return fmt.Errorf("unknown hash algorithm %q", cfg.FileSystem.Hash)
+	}
+
+	switch cfg.FileSystem.Backup.OnDelete {
+	case "":
+		cfg.FileSystem.Backup.OnDelete = OnDeleteIgnore
+	case OnDeleteIgnore, OnDeleteMirror, OnDeleteTrash:
+	default:
+		return fmt.Errorf("unknown backup on_delete policy %q", cfg.FileSystem.Backup.OnDelete)
+	}
+	return nil
+}
+
 func GetStaticBackupFolder() string {
 	return staticBackupFolder
 }
+
+// BackupFolders returns the "Backup Files" folder of every drive backed up into.
+func BackupFolders() []string {
+	folders := []string{filepath.Join(cfg.FileSystem.Backup.HardDrivePath, staticBackupFolder)}
+	for i := range cfg.FileSystem.Paths {
+		folder := cfg.FileSystem.Paths[i].BackupFolder()
+		if !contains(folders, folder) {
+			folders = append(folders, folder)
+		}
+	}
+	return folders
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ManifestFile returns the location of the backup manifest, by default kept on the backup drive.
+func ManifestFile() string {
+	if cfg.FileSystem.Backup.Manifest != "" {
+		return cfg.FileSystem.Backup.Manifest
+	}
+	return filepath.Join(cfg.FileSystem.Backup.HardDrivePath, staticBackupFolder, ".manifest.db")
+}
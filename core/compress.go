@@ -0,0 +1,189 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/utils"
+)
+
+// errUnsupported the image can not be compressed in Go, ImageMagick may still do it.
+var errUnsupported = errors.New("unsupported image")
+
+// compress lowers the quality of the image at filePath, returning the hex sum of the
+// compressed file, empty when it was left as is. JPEG and PNG are compressed in Go,
+// the other formats by ImageMagick when it is installed.
+func (c *builder) compress(quality int, filePath, interlace string) string {
+	duration := time.Now()
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		logger.Error().Err(err).Msg("load file")
+		return ""
+	}
+	beforeSize := fi.Size()
+
+	done, err := compressImage(filePath, quality)
+	if errors.Is(err, errUnsupported) {
+		done, err = magick(filePath, quality, interlace)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg(fmt.Sprintf("compress image %s", filePath))
+		return ""
+	}
+	if !done {
+		logger.Info(time.Since(duration)).Msg(fmt.Sprintf("file %s already compressed", filePath))
+		return ""
+	}
+
+	fl, _ := os.Stat(filePath)
+	afterSize := fl.Size()
+	logger.Info(time.Since(duration)).Dur("duration", time.Since(duration)).Msg(fmt.Sprintf("compress file is done, filesize before %d, after %d", beforeSize, afterSize))
+
+	sum, _, err := utils.HashFile(filePath, config.FileSystemCfg.Hash, nil)
+	if err != nil {
+		logger.Warn().Err(err).Str("path", filePath).Msg("hash compressed copy")
+	}
+	return sum
+}
+
+// compressImage re-encodes a JPEG above quality at quality and a PNG at the best
+// compression, reporting whether the image was replaced.
+func compressImage(name string, quality int) (bool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false, errUnsupported
+	}
+
+	switch format {
+	case "jpeg":
+		q, err := jpegQuality(bytes.NewReader(data))
+		if err != nil {
+			return false, errUnsupported
+		}
+		if quality >= q {
+			return false, nil
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return false, errUnsupported
+		}
+		return replaceSmaller(name, int64(len(data)), func(w io.Writer) error {
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+		})
+	case "png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return false, errUnsupported
+		}
+		enc := &png.Encoder{CompressionLevel: png.BestCompression}
+		return replaceSmaller(name, int64(len(data)), func(w io.Writer) error {
+			return enc.Encode(w, img)
+		})
+	}
+	return false, errUnsupported
+}
+
+// replaceSmaller writes the output of encode next to name and renames it over name
+// when it is smaller than size. name is replaced, never written through, so the
+// files linked to it keep their content.
+func replaceSmaller(name string, size int64, encode func(w io.Writer) error) (bool, error) {
+	tmp, err := tempName(name)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	if err := encode(f); err != nil {
+		_ = f.Close()
+		return false, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return false, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if fi.Size() >= size {
+		return false, nil
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return false, err
+	}
+	syncDir(filepath.Dir(name))
+	return true, nil
+}
+
+// magick compresses the image at name with ImageMagick, the fallback for the formats
+// Go does not encode.
+func magick(name string, quality int, interlace string) (bool, error) {
+	identify, err := exec.LookPath("identify")
+	if err != nil {
+		return false, fmt.Errorf("unsupported image and no ImageMagick installed")
+	}
+	convert, err := exec.LookPath("convert")
+	if err != nil {
+		return false, fmt.Errorf("unsupported image and no ImageMagick installed")
+	}
+
+	out, err := exec.Command(identify, "-format", "%Q", name).Output()
+	if err != nil {
+		return false, fmt.Errorf("incorrect file name %s: %w", name, err)
+	}
+	qualityNum, _ := strconv.Atoi(strings.TrimSpace(string(out)))
+	if quality >= qualityNum {
+		return false, nil
+	}
+
+	tmp, err := tempName(name)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	// the format of the output is named, its extension being the temporary one
+	format := strings.ToUpper(strings.TrimPrefix(filepath.Ext(name), "."))
+	cmd := exec.Command(convert, name,
+		"-sampling-factor", "4:2:0",
+		"-strip",
+		"-quality", strconv.Itoa(quality),
+		"-interlace", interlace,
+		"-colorspace", "sRGB",
+		format+":"+tmp)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return false, fmt.Errorf("convert: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		return false, err
+	}
+	syncDir(filepath.Dir(name))
+	return true, nil
+}
@@ -1,113 +1,381 @@
 package core
 
 import (
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
+	"github.com/hinha/watchgo/utils"
 )
 
 type builder struct{}
 
 func (c *builder) createFolder(subPath []string) string {
-	dstFolder, subFolder := subPath[0], subPath[1]
-	if strings.HasPrefix(subFolder, "/") {
-		// remove trailing slash
-		subFolder = subFolder[1:]
+	originPath := backupFolder(subPath)
+	if err := os.MkdirAll(originPath, os.ModePerm); err != nil {
+		logger.Error().Err(err).Msg("creating folder")
+		return ""
 	}
 
-	dfs := strings.Split(dstFolder, "/")
-	dstFolder = dfs[len(dfs)-1:][0]
+	// the folders below the namespace mirror the local ones
+	dir := filepath.Dir(strings.TrimPrefix(subPath[1], "/"))
+	if dir != "." {
+		dstRoot := strings.TrimSuffix(originPath, dir)
+		if err := c.preserveDirs(subPath[0], dstRoot, dir); err != nil {
+			logger.Warn().Err(err).Str("path", originPath).Msg("preserve folder metadata")
+		}
+	}
 
-	// remove it file with extension abc.foo
-	fsp := strings.SplitAfterN(subFolder, "/", -1)
-	fd := strings.Join(fsp[:len(fsp)-1], "")
-	if len(fd) > 1 {
-		subFolder = fd[:len(fd)-1]
-	} else {
-		subFolder = ""
+	return originPath
+}
+
+func (c *builder) rename(srcPath, dstPath string) error {
+	duration := time.Now()
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
 	}
 
-	originPath := path.Join(config.FileSystemCfg.Backup.HardDrivePath, config.GetStaticBackupFolder(), dstFolder, subFolder)
-	if err := os.MkdirAll(originPath, os.ModePerm); err != nil {
-		logger.Error().Err(err).Msg("creating folder")
-		return ""
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return err
 	}
+	logger.Info(time.Since(duration)).Msg(fmt.Sprintf("move backup %s into %s was successfully", srcPath, dstPath))
+	return nil
+}
 
-	return originPath
+// copied describes a file written into the backup drive.
+type copied struct {
+	// sum hex sum of the source content.
+	sum string
+	// verified whether the written file was read back and matched sum.
+	verified bool
+	// backup the hex sum of the copy when processing changed it after the copy.
+	backup string
+	// derivative the compressed copy kept apart from the backup, derivativeSum its hex sum.
+	derivative    string
+	derivativeSum string
+	// meta what the processor extracted from the file.
+	meta map[string]string
+	// mediaType the type of the source content.
+	mediaType string
 }
 
-func (c *builder) copy(srcPath, dstPath string) {
+func (c *builder) copy(srcPath, dstPath string) (copied, error) {
 	duration := time.Now()
-	sourceFileStat, _ := os.Stat(srcPath)
+	sourceFileStat, err := os.Stat(srcPath)
+	if err != nil {
+		return copied{}, err
+	}
 	if !sourceFileStat.Mode().IsRegular() {
-		logger.Error().Err(fmt.Errorf("error %s is not a regular file", srcPath)).Msg("")
-		return
+		return copied{}, fmt.Errorf("error %s is not a regular file", srcPath)
 	}
 
 	source, err := os.Open(srcPath)
 	if err != nil {
-		logger.Error().Err(err).Msg("source open file")
-		return
+		return copied{}, fmt.Errorf("source open file: %w", err)
 	}
 	defer source.Close()
 
-	destination, err := os.Create(dstPath)
+	if config.FileSystemCfg.Backup.Dedup {
+		cp, err := c.link(source, dstPath)
+		if err != nil {
+			return copied{}, fmt.Errorf("destination link file: %w", err)
+		}
+		// the links of an object share its metadata, the last copy wins
+		if err := c.preserve(srcPath, dstPath); err != nil {
+			logger.Warn().Err(err).Str("path", dstPath).Msg("preserve metadata")
+		}
+		logger.Info(time.Since(duration)).Msg(fmt.Sprintf("link file %s into %s was successfully", filepath.Base(srcPath), dstPath))
+		return cp, nil
+	}
+
+	cp, err := writeFile(dstPath, source)
+	if err != nil {
+		return copied{}, fmt.Errorf("destination create file: %w", err)
+	}
+	if err := c.preserve(srcPath, dstPath); err != nil {
+		logger.Warn().Err(err).Str("path", dstPath).Msg("preserve metadata")
+	}
+	logger.Info(time.Since(duration)).Msg(fmt.Sprintf("copy file %s into %s was successfully", filepath.Base(srcPath), dstPath))
+	return cp, nil
+}
+
+// tempSuffix marks the partial copies, removed on startup if a crash left them behind.
+const tempSuffix = ".watchgo-tmp"
+
+// tempName returns a hidden name next to dstPath to write it before renaming it into place.
+func tempName(dstPath string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".*"+tempSuffix)
+	if err != nil {
+		return "", err
+	}
+	_ = f.Close()
+	return f.Name(), nil
+}
+
+// writeFile replaces dstPath with the content of r. The content is written to a
+// temporary file, synced to disk and then renamed into place so dstPath is never
+// left truncated, nor written through when it is a hard link. With backup versions
+// enabled the replaced backup is kept as a version.
+func writeFile(dstPath string, r io.ReadSeeker) (copied, error) {
+	tmp, err := tempName(dstPath)
+	if err != nil {
+		return copied{}, err
+	}
+
+	cp, err := writeVerified(tmp, r)
+	if err == nil {
+		// the version shares the replaced backup, dstPath stays valid until the rename
+		err = keepVersion(dstPath, cp.sum)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dstPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return copied{}, err
+	}
+	syncDir(filepath.Dir(dstPath))
+	return cp, nil
+}
+
+// verifyAttempts how many times a copy is written when reading it back does not match.
+const verifyAttempts = 3
+
+// writeVerified copies r into name. With backup verify enabled the written file is
+// read back and compared with the sum of r, copying again on mismatch. The file is
+// dropped from the page cache first where the system allows it, so the read back
+// checks the drive rather than memory.
+func writeVerified(name string, r io.ReadSeeker) (copied, error) {
+	if !config.FileSystemCfg.Backup.Verify {
+		sum, err := writeSync(name, r)
+		return copied{sum: sum}, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		sum, err := writeSync(name, r)
+		if err != nil {
+			return copied{}, err
+		}
+
+		if err := dropCache(name); err != nil {
+			logger.Warn().Err(err).Str("path", name).Msg("drop page cache")
+		}
+		back, _, err := utils.HashFile(name, config.FileSystemCfg.Hash, nil)
+		if err != nil {
+			return copied{}, err
+		}
+		if back == sum {
+			return copied{sum: sum, verified: true}, nil
+		}
+
+		if attempt == verifyAttempts {
+			return copied{}, fmt.Errorf("verify %s: read back %s does not match %s", name, back, sum)
+		}
+		logger.Warn().Str("path", name).Int("attempt", attempt).Msg("verify mismatch, copy again")
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return copied{}, err
+		}
+	}
+}
+
+// writeSync copies r into name and flushes it to disk, returning the hex sum of r.
+func writeSync(name string, r io.Reader) (string, error) {
+	destination, err := os.Create(name)
 	if err != nil {
-		logger.Error().Err(err).Msg("destination create file")
-		return
+		return "", err
 	}
 	defer destination.Close()
 
-	_, _ = io.Copy(destination, source)
-	logger.Info(time.Since(duration)).Msg(fmt.Sprintf("copy file %s into %s was successfully", filepath.Base(srcPath), dstPath))
+	// sum the source while copying it
+	h, err := utils.NewHash(config.FileSystemCfg.Hash)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(destination, io.TeeReader(r, h)); err != nil {
+		return "", err
+	}
+	if err := destination.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), destination.Close()
 }
 
-func (c *builder) compress(quality int, filePath, interlace string) {
-	duration := time.Now()
-	fi, err := os.Stat(filePath)
+// clone makes dstPath a copy of srcPath, sharing its storage when the drive has hard
+// links. dstPath is replaced, not written through.
+func (c *builder) clone(srcPath, dstPath string) error {
+	return cloneFile(srcPath, dstPath)
+}
+
+func cloneFile(srcPath, dstPath string) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := tempName(dstPath)
 	if err != nil {
-		logger.Error().Err(err).Msg("load file")
-		return
+		return err
+	}
+	_ = os.Remove(tmp)
+
+	if err := os.Link(srcPath, tmp); err != nil {
+		// the drive has no hard links, keep a plain copy
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := writeSync(tmp, f); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, dstPath); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (c *builder) remove(dstPath string) error {
+	duration := time.Now()
+	if err := os.RemoveAll(dstPath); err != nil {
+		return err
+	}
+	logger.Info(time.Since(duration)).Msg(fmt.Sprintf("remove backup %s was successfully", dstPath))
+	return nil
+}
+
+// backupFolder returns the folder in the backup drive mirroring subPath, without the file name.
+func backupFolder(subPath []string) string {
+	dstFolder, subFolder := subPath[0], subPath[1]
+	if strings.HasPrefix(subFolder, "/") {
+		// remove trailing slash
+		subFolder = subFolder[1:]
+	}
+
+	backupFolder := path.Join(config.FileSystemCfg.Backup.HardDrivePath, config.GetStaticBackupFolder())
+	if p, ok := config.FileSystemCfg.Lookup(dstFolder); ok {
+		backupFolder, dstFolder = p.BackupFolder(), p.Namespace()
+	} else {
+		dfs := strings.Split(dstFolder, "/")
+		dstFolder = dfs[len(dfs)-1:][0]
+	}
+
+	// remove it file with extension abc.foo
+	fsp := strings.SplitAfterN(subFolder, "/", -1)
+	fd := strings.Join(fsp[:len(fsp)-1], "")
+	if len(fd) > 1 {
+		subFolder = fd[:len(fd)-1]
+	} else {
+		subFolder = ""
 	}
-	beforeSize := fi.Size()
 
-	cmd := fmt.Sprintf("identify -format %s '%s'", "'%Q'", filePath)
-	out, err := exec.Command("bash", "-c", cmd).Output()
+	return path.Join(backupFolder, dstFolder, subFolder)
+}
+
+// record stores the backup of lPath at dstPath in the manifest, fi and cp describing
+// the local file at the time it was copied.
+func record(lPath, dstPath string, fi os.FileInfo, cp copied) {
+	e := manifest.Entry{
+		Source:     lPath,
+		Backup:     dstPath,
+		Size:       fi.Size(),
+		ModTime:    fi.ModTime(),
+		Hash:       cp.sum,
+		HashAlgo:   config.FileSystemCfg.Hash,
+		BackupHash: cp.sum,
+		BackupTime: time.Now(),
+		Verified:   cp.verified,
+	}
+	if cp.backup != "" {
+		e.BackupHash = cp.backup
+	}
+	if len(cp.meta) > 0 {
+		e.Meta = cp.meta
+	}
+	e.Type = cp.mediaType
+	if cp.derivative != "" {
+		e.Derivative, e.DerivativeHash = cp.derivative, cp.derivativeSum
+	}
+	if cp.verified {
+		e.VerifiedAt = e.BackupTime
+	}
+
+	err := manifest.Put(e)
 	if err != nil {
-		logger.Error().Err(err).Msg(fmt.Sprintf("incorrect file name %s", filePath))
-		return
+		logger.Error().Err(err).Msg("update manifest")
 	}
+}
+
+// BackupPath returns where the backup of subPath is stored, subPath being a watched
+// path and the remainder below it.
+func BackupPath(subPath []string) string {
+	return path.Join(backupFolder(subPath), path.Base(subPath[1]))
+}
 
-	qualityNum, _ := strconv.ParseInt(string(out), 10, 0)
-	if int64(quality) >= qualityNum {
-		logger.Info(time.Since(duration)).Msg(fmt.Sprintf("file %s already compressed", filePath))
-		return
+// SourcePath is the inverse of BackupPath, it returns the local file a backup was copied from.
+func SourcePath(backupPath string) (string, bool) {
+	for _, p := range config.FileSystemCfg.Paths {
+		rel, err := filepath.Rel(filepath.Join(p.BackupFolder(), p.Namespace()), backupPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return filepath.Join(p.Path, rel), true
 	}
+	return "", false
+}
 
-	cmd = fmt.Sprintf("convert '%s' -sampling-factor 4:2:0 -strip -quality %d -interlace %s -colorspace sRGB '%s'",
-		filePath,
-		quality,
-		interlace,
-		filePath)
+// settings returns the configuration of the watched path of subPath.
+func settings(subPath []string) *config.PathConfig {
+	if p, ok := config.FileSystemCfg.Lookup(subPath[0]); ok {
+		return p
+	}
+	return &config.PathConfig{Path: subPath[0]}
+}
 
-	if _, err := exec.Command("bash", "-c", cmd).Output(); err != nil {
-		logger.Error().Err(err).Msg("compress image")
+// CleanTemp removes the partial copies an interrupted copy left in the backup drives.
+func (i *File) CleanTemp() error {
+	for _, folder := range config.BackupFolders() {
+		err := filepath.WalkDir(folder, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(d.Name(), tempSuffix) {
+				return i.builder.remove(path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	fl, _ := os.Stat(filePath)
-	afterSize := fl.Size()
-	logger.Info(time.Since(duration)).Dur("duration", time.Since(duration)).Msg(fmt.Sprintf("compress file is done, filesize before %d, after %d", beforeSize, afterSize))
+// backupRoot returns the "Backup Files" folder holding name.
+func backupRoot(name string) string {
+	for _, folder := range config.BackupFolders() {
+		if strings.HasPrefix(name, folder+string(filepath.Separator)) {
+			return folder
+		}
+	}
+	return path.Join(config.FileSystemCfg.Backup.HardDrivePath, config.GetStaticBackupFolder())
 }
 
 func NewBuilder() Builder {
+	if config.DryRun {
+		return &dryBuilder{}
+	}
 	return &builder{}
 }
@@ -3,11 +3,10 @@
 package core
 
 import (
-	"fmt"
+	"os"
 	"regexp"
-	"strings"
+	"syscall"
 
-	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/logger"
 )
 
@@ -17,16 +16,28 @@ func init() {
 
 var IsJpg, _ = regexp.Compile(`^.*.(JPG|jpeg|JPEG|jpg)$`)
 
-func Regexp() string {
-	if len(config.FileSystemCfg.Backup.Prefix) > 0 && config.FileSystemCfg.Backup.Prefix[0] != "*" {
-		prefix := fmt.Sprintf(`(%s).*.(JPG|jpeg|JPEG|jpg|png|PNG|pdf)$`, strings.Join(config.FileSystemCfg.Backup.Prefix, "|"))
-		return prefix
+type Builder interface {
+	compress(quality int, imagePath, interlace string) string
+	createFolder(subPath []string) string
+	copy(srcPath, dstPath string) (copied, error)
+	rename(srcPath, dstPath string) error
+	remove(dstPath string) error
+	preserve(srcPath, dstPath string) error
+	clone(srcPath, dstPath string) error
+}
+
+// linkCount returns the number of hard links to the file, zero when unknown.
+func linkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
 	}
-	return `^.*.(JPG|jpeg|JPEG|jpg|png|PNG|pdf)$`
+	return 0
 }
 
-type Builder interface {
-	compress(quality int, imagePath, interlace string)
-	createFolder(subPath []string) string
-	copy(srcPath, dstPath string)
+// syncDir flushes the entries of dir, making a rename inside it durable.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
 }
@@ -3,11 +3,9 @@
 package core
 
 import (
-	"fmt"
+	"os"
 	"regexp"
-	"strings"
 
-	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/logger"
 )
 
@@ -17,16 +15,20 @@ func init() {
 
 var IsJpg, _ = regexp.Compile(`^.*.(JPG|jpeg|JPEG|jpg)$`)
 
-func Regexp() string {
-	if len(config.FileSystemCfg.Backup.Prefix) > 0 && config.FileSystemCfg.Backup.Prefix[0] != "*" {
-		prefix := fmt.Sprintf(`(%s).*.(JPG|jpeg|JPEG|jpg|png|PNG|pdf)$`, strings.Join(config.FileSystemCfg.Backup.Prefix, "|"))
-		return prefix
-	}
-	return `^.*.(JPG|jpeg|JPEG|jpg|png|PNG|pdf)$`
-}
-
 type Builder interface {
-	compress(quality int, imagePath, interlace string)
+	compress(quality int, imagePath, interlace string) string
 	createFolder(subPath []string) string
-	copy(srcPath, dstPath string)
+	copy(srcPath, dstPath string) (copied, error)
+	rename(srcPath, dstPath string) error
+	remove(dstPath string) error
+	preserve(srcPath, dstPath string) error
+	clone(srcPath, dstPath string) error
 }
+
+// linkCount returns the number of hard links to the file, zero when unknown.
+func linkCount(fi os.FileInfo) uint64 {
+	return 0
+}
+
+// syncDir is a no-op, directories cannot be synced on windows.
+func syncDir(dir string) {}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/utils"
+)
+
+// objectsFolder stores each distinct content once when backup dedup is enabled, the
+// backups being hard links to it. Objects are named after the hash of the source
+// content, under a folder per algorithm.
+const objectsFolder = ".objects"
+
+var (
+	linksMu sync.Mutex
+	// links object store -> whether its drive supports hard links.
+	links = make(map[string]bool)
+)
+
+// objectsDir returns the object store on the drive of dstPath.
+func objectsDir(dstPath string) string {
+	return path.Join(backupRoot(dstPath), objectsFolder)
+}
+
+// link copies r into the object store, unless the same content is already there,
+// and links dstPath to the object. A drive without hard links gets a plain copy and
+// no object, nothing would link to it.
+func (c *builder) link(r io.ReadSeeker, dstPath string) (copied, error) {
+	dir := objectsDir(dstPath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return copied{}, err
+	}
+	if !linkable(dir) {
+		return writeFile(dstPath, r)
+	}
+
+	tmp, err := tempName(path.Join(dir, "object"))
+	if err != nil {
+		return copied{}, err
+	}
+	defer os.Remove(tmp)
+
+	cp, err := writeVerified(tmp, r)
+	if err != nil {
+		return copied{}, err
+	}
+
+	object := path.Join(dir, config.FileSystemCfg.Hash, cp.sum[:2], cp.sum)
+	if !c.hasObject(object, cp) {
+		if err := os.MkdirAll(filepath.Dir(object), os.ModePerm); err != nil {
+			return copied{}, err
+		}
+		if err := os.Rename(tmp, object); err != nil {
+			return copied{}, err
+		}
+	}
+
+	// link next to dstPath first, then rename over it
+	tmpLink, err := tempName(dstPath)
+	if err != nil {
+		return copied{}, err
+	}
+	_ = os.Remove(tmpLink)
+	if err := os.Link(object, tmpLink); err != nil {
+		// the drive has no hard links, keep a plain copy
+		logger.Debug().Err(err).Str("path", dstPath).Msg("link object")
+		f, err := os.Open(object)
+		if err != nil {
+			return copied{}, err
+		}
+		defer f.Close()
+		return writeFile(dstPath, f)
+	}
+
+	if err := keepVersion(dstPath, cp.sum); err != nil {
+		_ = os.Remove(tmpLink)
+		return copied{}, err
+	}
+	if err := os.Rename(tmpLink, dstPath); err != nil {
+		_ = os.Remove(tmpLink)
+		return copied{}, err
+	}
+	return cp, nil
+}
+
+// linkable reports whether the drive of the object store dir supports hard links,
+// trying once per store.
+func linkable(dir string) bool {
+	linksMu.Lock()
+	defer linksMu.Unlock()
+	if ok, found := links[dir]; found {
+		return ok
+	}
+
+	// a store that cannot be written to is tried again next time
+	name, err := tempName(path.Join(dir, "probe"))
+	if err != nil {
+		return false
+	}
+	defer os.Remove(name)
+	link, err := tempName(path.Join(dir, "probe"))
+	if err != nil {
+		return false
+	}
+	defer os.Remove(link)
+
+	_ = os.Remove(link)
+	err = os.Link(name, link)
+	if err != nil {
+		logger.Warn().Err(err).Str("path", dir).Msg("drive has no hard links, dedup stores plain copies")
+	}
+	links[dir] = err == nil
+	return err == nil
+}
+
+// hasObject reports whether object already holds the content of cp. With backup
+// verify enabled the object is read back, a damaged one is replaced.
+func (c *builder) hasObject(object string, cp copied) bool {
+	if _, err := os.Stat(object); err != nil {
+		return false
+	}
+	if !cp.verified {
+		return true
+	}
+
+	sum, _, err := utils.HashFile(object, config.FileSystemCfg.Hash, nil)
+	if err != nil || sum != cp.sum {
+		logger.Warn().Str("path", object).Msg("object does not match its content, replace it")
+		return false
+	}
+	return true
+}
+
+// PruneObjects deletes the objects no backup links to anymore, on every drive. The
+// link count of an object tells nothing on a drive without hard links, its store
+// is left as is.
+func (i *File) PruneObjects() error {
+	for _, folder := range config.BackupFolders() {
+		if err := i.pruneObjects(path.Join(folder, objectsFolder)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *File) pruneObjects(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	// a dry run leaves the drive untouched, probe included, and only logs the
+	// objects to prune
+	if !config.DryRun && !linkable(dir) {
+		return nil
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if n := linkCount(fi); n == 1 {
+			return i.builder.remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
+)
+
+// derive stores the compressed copy of the backup dstPath of lPath in the optimized
+// tree, returning its path and hex sum. Nothing is kept when compressing leaves the
+// image as is.
+func (i *Image) derive(lPath, dstPath string, quality int, interlace string) (string, string) {
+	derivative := derivativePath(dstPath)
+	// compressing replaces the clone, the backup keeps its content
+	if err := i.builder.clone(dstPath, derivative); err != nil {
+		logger.Error().Err(err).Msg("clone backup")
+		return "", ""
+	}
+
+	sum := i.builder.compress(quality, derivative, interlace)
+	if sum == "" {
+		if err := i.builder.remove(derivative); err != nil {
+			logger.Error().Err(err).Msg("remove derivative")
+		}
+		return "", ""
+	}
+	if err := i.builder.preserve(lPath, derivative); err != nil {
+		logger.Warn().Err(err).Str("path", derivative).Msg("preserve metadata")
+	}
+	return derivative, sum
+}
+
+// derivativePath returns where the compressed copy of the backup dstPath is stored,
+// at the same place in the optimized tree of its drive.
+func derivativePath(dstPath string) string {
+	root := backupRoot(dstPath)
+	rel, _ := filepath.Rel(root, dstPath)
+	return filepath.Join(root, config.OptimizedFolder, rel)
+}
+
+// moveDerivative follows the rename of the backup oldBackup to newBackup, a file or
+// a directory, in the optimized tree and in the manifest.
+func (i *File) moveDerivative(oldBackup, newBackup string) error {
+	old := derivativePath(oldBackup)
+	if _, err := os.Stat(old); err != nil {
+		return nil
+	}
+	if err := i.builder.rename(old, derivativePath(newBackup)); err != nil {
+		return err
+	}
+
+	for _, e := range manifest.Under(newBackup) {
+		if e.Derivative == "" {
+			continue
+		}
+		e.Derivative = derivativePath(e.Backup)
+		if err := manifest.Put(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDerivative removes the compressed copies of the backup backupPath, a file or
+// a directory. They are made again from the backup when needed.
+func (i *File) removeDerivative(backupPath string) error {
+	derivative := derivativePath(backupPath)
+	if _, err := os.Stat(derivative); err != nil {
+		return nil
+	}
+	return i.builder.remove(derivative)
+}
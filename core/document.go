@@ -0,0 +1,64 @@
+package core
+
+import (
+	"path/filepath"
+	"strconv"
+
+	"github.com/ledongthuc/pdf"
+
+	"github.com/hinha/watchgo/logger"
+)
+
+func NewDocumentReader(builder Builder) *Document {
+	return &Document{builder: builder}
+}
+
+// Document backs up documents losslessly, never through the image compression, and
+// records what their metadata tells in the manifest.
+type Document struct {
+	builder Builder
+}
+
+func (d *Document) Open(lPath string, subPath []string, mediaType string) error {
+	dstPath, fi, cp, err := copyFile(d.builder, lPath, subPath)
+	if err != nil {
+		return err
+	}
+	cp.mediaType = mediaType
+	cp.meta = documentMeta(lPath, mediaType)
+	record(filepath.Clean(lPath), dstPath, fi, cp)
+
+	return nil
+}
+
+// documentMeta returns the page count, title and author of a PDF, nil for the other
+// documents or when it can not be read.
+func documentMeta(name, mediaType string) (meta map[string]string) {
+	if mediaType != "application/pdf" {
+		return nil
+	}
+
+	// the parser panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Debug().Str("path", name).Interface("panic", r).Msg("read pdf metadata")
+			meta = nil
+		}
+	}()
+
+	f, r, err := pdf.Open(name)
+	if err != nil {
+		logger.Debug().Err(err).Str("path", name).Msg("read pdf metadata")
+		return nil
+	}
+	defer f.Close()
+
+	meta = map[string]string{"pages": strconv.Itoa(r.NumPage())}
+	info := r.Trailer().Key("Info")
+	for key, field := range map[string]string{"title": "Title", "author": "Author"} {
+		if v := info.Key(field).Text(); v != "" {
+			meta[key] = v
+		}
+	}
+	return meta
+}
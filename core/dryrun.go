@@ -0,0 +1,55 @@
+package core
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hinha/watchgo/logger"
+)
+
+// dryBuilder logs what the builder would do with the backup drive, leaving it untouched.
+type dryBuilder struct{}
+
+func (c *dryBuilder) createFolder(subPath []string) string {
+	originPath := backupFolder(subPath)
+	if _, err := os.Stat(originPath); os.IsNotExist(err) {
+		logger.Info(0).Msg(fmt.Sprintf("dry run, create folder %s", originPath))
+	}
+	return originPath
+}
+
+func (c *dryBuilder) copy(srcPath, dstPath string) (copied, error) {
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return copied{}, err
+	}
+	if !fi.Mode().IsRegular() {
+		return copied{}, fmt.Errorf("error %s is not a regular file", srcPath)
+	}
+	logger.Info(0).Msg(fmt.Sprintf("dry run, copy file %s into %s", srcPath, dstPath))
+	return copied{}, nil
+}
+
+func (c *dryBuilder) compress(quality int, filePath, interlace string) string {
+	logger.Info(0).Msg(fmt.Sprintf("dry run, compress file %s with quality %d", filePath, quality))
+	return ""
+}
+
+func (c *dryBuilder) rename(srcPath, dstPath string) error {
+	logger.Info(0).Msg(fmt.Sprintf("dry run, rename backup %s to %s", srcPath, dstPath))
+	return nil
+}
+
+func (c *dryBuilder) remove(dstPath string) error {
+	logger.Info(0).Msg(fmt.Sprintf("dry run, remove backup %s", dstPath))
+	return nil
+}
+
+func (c *dryBuilder) preserve(srcPath, dstPath string) error {
+	return nil
+}
+
+func (c *dryBuilder) clone(srcPath, dstPath string) error {
+	logger.Info(0).Msg(fmt.Sprintf("dry run, clone backup %s into %s", srcPath, dstPath))
+	return nil
+}
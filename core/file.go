@@ -6,7 +6,7 @@ import (
 	"path"
 	"path/filepath"
 
-	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/manifest"
 	"github.com/hinha/watchgo/utils"
 )
 
@@ -18,26 +18,55 @@ type File struct {
 	builder Builder
 }
 
-func (i *File) Open(lPath string, subPath []string) error {
-	folder := i.builder.createFolder(subPath)
+func (i *File) Open(lPath string, subPath []string, mediaType string) error {
+	dstPath, fi, cp, err := copyFile(i.builder, lPath, subPath)
+	if err != nil {
+		return err
+	}
+	cp.mediaType = mediaType
+	record(filepath.Clean(lPath), dstPath, fi, cp)
+
+	return nil
+}
+
+// copyFile copies lPath into its backup folder as is, within the size limit of its
+// watched path. It returns where the copy is and the local file it was made from.
+func copyFile(builder Builder, lPath string, subPath []string) (string, os.FileInfo, copied, error) {
+	folder := builder.createFolder(subPath)
 	if folder == "" {
-		return fmt.Errorf("error creating folder")
+		return "", nil, copied{}, fmt.Errorf("error creating folder")
 	}
 
 	fi, err := os.Stat(lPath)
 	if err != nil {
-		return err
+		return "", nil, copied{}, err
 	}
 
 	size := utils.ByteSize(fi.Size())
-	maxSize := utils.ByteSize(config.FileSystemCfg.MaxFileSize) * utils.MB
-	if size >= maxSize {
-		return fmt.Errorf("size limits on the file %s of maximum, %s", fi.Name(), maxSize.String())
+	maxSize := utils.ByteSize(settings(subPath).GetMaxFileSize()) * utils.MB
+	if maxSize > 0 && size >= maxSize {
+		return "", nil, copied{}, fmt.Errorf("size limits on the file %s of maximum, %s", fi.Name(), maxSize.String())
 	}
 
-	lPath = filepath.Clean(lPath)
 	dstPath := filepath.Clean(path.Join(folder, fi.Name()))
-	i.builder.copy(lPath, dstPath)
+	cp, err := builder.copy(filepath.Clean(lPath), dstPath)
+	if err != nil {
+		return "", nil, copied{}, err
+	}
+	return dstPath, fi, cp, nil
+}
 
-	return nil
+// Move renames the existing backup at backupPath to the backup location of subPath,
+// used when the local file or directory was renamed instead of copying it again.
+func (i *File) Move(backupPath string, subPath []string) error {
+	dstPath := BackupPath(subPath)
+	if err := i.builder.rename(backupPath, dstPath); err != nil {
+		return err
+	}
+
+	oldSource, _ := SourcePath(backupPath)
+	if err := manifest.Move(backupPath, dstPath, oldSource, filepath.Join(subPath...)); err != nil {
+		return err
+	}
+	return i.moveDerivative(backupPath, dstPath)
 }
@@ -1,10 +1,9 @@
 package core
 
 import (
-	"github.com/hinha/watchgo/config"
-	"os"
-	"path"
 	"path/filepath"
+
+	"github.com/hinha/watchgo/logger"
 )
 
 var (
@@ -20,22 +19,33 @@ type Image struct {
 	builder Builder
 }
 
-func (i *Image) Open(lPath string, subPath []string) error {
-	folder := i.builder.createFolder(subPath)
-	fi, _ := os.Stat(lPath)
-
+func (i *Image) Open(lPath string, subPath []string, mediaType string) error {
+	dstPath, fi, cp, err := copyFile(i.builder, lPath, subPath)
+	if err != nil {
+		return err
+	}
 	lPath = filepath.Clean(lPath)
-	dstPath := filepath.Clean(path.Join(folder, fi.Name()))
-	i.builder.copy(lPath, dstPath)
 
 	interlace := cmdPNG
 	if IsJpg.MatchString(lPath) {
 		interlace = cmdJPG
 	}
 
-	if config.FileSystemCfg.Compress.Enabled {
-		i.builder.compress(config.FileSystemCfg.Compress.Quality, dstPath, interlace)
+	if compress := settings(subPath).GetCompress(); compress.Enabled && compress.KeepOriginal {
+		cp.derivative, cp.derivativeSum = i.derive(lPath, dstPath, compress.Quality, interlace)
+	} else if compress.Enabled {
+		if sum := i.builder.compress(compress.Quality, dstPath, interlace); sum != "" {
+			// the read back checked the copy compression replaced, watchgo verify
+			// checks the compressed one
+			cp.backup, cp.verified = sum, false
+			// compressing rewrote the copy
+			if err := i.builder.preserve(lPath, dstPath); err != nil {
+				logger.Warn().Err(err).Str("path", dstPath).Msg("preserve metadata")
+			}
+		}
 	}
+	cp.mediaType = mediaType
+	record(lPath, dstPath, fi, cp)
 
 	return nil
 }
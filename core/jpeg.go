@@ -0,0 +1,149 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// stdLuminance the luminance quantization table of the JPEG standard, scaled by the
+// encoders for their quality setting.
+var stdLuminance = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+var errNoQuantization = errors.New("jpeg: no luminance quantization table")
+
+// jpegQuality estimates the quality a JPEG was encoded with from its luminance
+// quantization table, inverting the scaling of the standard table.
+func jpegQuality(r io.Reader) (int, error) {
+	table, err := luminanceTable(bufio.NewReader(r))
+	if err != nil {
+		return 0, err
+	}
+
+	var sum, std int
+	for i := range table {
+		sum += table[i]
+		std += stdLuminance[i]
+	}
+
+	scale := float64(sum) * 100 / float64(std)
+	var q float64
+	if scale <= 100 {
+		q = (200 - scale) / 2
+	} else {
+		q = 5000 / scale
+	}
+
+	quality := int(q + 0.5)
+	if quality < 1 {
+		quality = 1
+	}
+	if quality > 100 {
+		quality = 100
+	}
+	return quality, nil
+}
+
+// luminanceTable reads the markers up to the image data and returns the table 0,
+// the luminance one.
+func luminanceTable(r *bufio.Reader) ([64]int, error) {
+	var table [64]int
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return table, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return table, errors.New("jpeg: missing SOI marker")
+	}
+
+	for {
+		marker, err := nextMarker(r)
+		if err != nil {
+			return table, err
+		}
+		switch {
+		case marker == 0xda || marker == 0xd9:
+			// start of scan or end of image, no table past it
+			return table, errNoQuantization
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// no length
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return table, err
+		}
+		if length < 2 {
+			return table, errors.New("jpeg: invalid marker length")
+		}
+		n := int(length) - 2
+
+		if marker != 0xdb {
+			if _, err := r.Discard(n); err != nil {
+				return table, err
+			}
+			continue
+		}
+
+		// one or more tables of 64 values, of 8 or 16 bits
+		for n > 0 {
+			pq, err := r.ReadByte()
+			if err != nil {
+				return table, err
+			}
+			n--
+			precision, id := pq>>4, pq&0x0f
+
+			var values [64]int
+			for i := range values {
+				if precision == 0 {
+					b, err := r.ReadByte()
+					if err != nil {
+						return table, err
+					}
+					values[i] = int(b)
+					n--
+					continue
+				}
+				var v uint16
+				if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+					return table, err
+				}
+				values[i] = int(v)
+				n -= 2
+			}
+			if id == 0 {
+				return values, nil
+			}
+		}
+	}
+}
+
+// nextMarker skips to the next marker and returns its code.
+func nextMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, errors.New("jpeg: expected a marker")
+	}
+	// fill bytes
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
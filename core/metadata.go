@@ -0,0 +1,75 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// preserve copies the metadata of srcPath selected by the backup preserve settings
+// onto dstPath. It returns the first failure, the content is left in place anyway.
+func (c *builder) preserve(srcPath, dstPath string) error {
+	opt := config.FileSystemCfg.Backup.Preserve
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if opt.Xattrs {
+		errs = append(errs, copyXattrs(srcPath, dstPath))
+	}
+	if opt.Owner && os.Geteuid() == 0 {
+		errs = append(errs, chown(dstPath, fi))
+	}
+	if opt.Mode {
+		errs = append(errs, os.Chmod(dstPath, fi.Mode().Perm()))
+	}
+	// last, the calls above may touch the times
+	if opt.Times {
+		errs = append(errs, os.Chtimes(dstPath, accessTime(fi), fi.ModTime()))
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preserveDirs applies the mode and owner of each folder of the local relative path
+// dir below root to the same folder below dstRoot.
+func (c *builder) preserveDirs(root, dstRoot, dir string) error {
+	opt := config.FileSystemCfg.Backup.Preserve
+	if !opt.Mode && !(opt.Owner && os.Geteuid() == 0) {
+		return nil
+	}
+
+	var rel string
+	for _, name := range strings.Split(filepath.ToSlash(dir), "/") {
+		if name == "" {
+			continue
+		}
+		rel = filepath.Join(rel, name)
+
+		fi, err := os.Stat(filepath.Join(root, rel))
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstRoot, rel)
+		if opt.Owner && os.Geteuid() == 0 {
+			if err := chown(dst, fi); err != nil {
+				return err
+			}
+		}
+		if opt.Mode {
+			if err := os.Chmod(dst, fi.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package core
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func accessTime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atimespec.Unix())
+	}
+	return fi.ModTime()
+}
+
+func chown(name string, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return os.Lchown(name, int(st.Uid), int(st.Gid))
+	}
+	return nil
+}
+
+// copyXattrs is a no-op, extended attributes are only copied on linux.
+func copyXattrs(src, dst string) error {
+	return nil
+}
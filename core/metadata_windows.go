@@ -0,0 +1,24 @@
+package core
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func accessTime(fi os.FileInfo) time.Time {
+	if d, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, d.LastAccessTime.Nanoseconds())
+	}
+	return fi.ModTime()
+}
+
+// chown is a no-op, windows has no uid and gid.
+func chown(name string, fi os.FileInfo) error {
+	return nil
+}
+
+// copyXattrs is a no-op, extended attributes are only copied on linux.
+func copyXattrs(src, dst string) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package core
+
+// Kinds of file, each backed up by its own processor.
+const (
+	KindImage    = "image"
+	KindDocument = "document"
+	KindArchive  = "archive"
+	KindGeneric  = "generic"
+)
+
+// Processor backs up one kind of file, mediaType being the type of its content.
+type Processor interface {
+	Open(lPath string, subPath []string, mediaType string) error
+}
+
+// kinds the kind of the media types, the others are generic.
+var kinds = map[string]string{
+	"image/jpeg":                   KindImage,
+	"image/png":                    KindImage,
+	"application/pdf":              KindDocument,
+	"application/zip":              KindArchive,
+	"application/x-tar":            KindArchive,
+	"application/gzip":             KindArchive,
+	"application/x-gzip":           KindArchive,
+	"application/x-bzip2":          KindArchive,
+	"application/x-xz":             KindArchive,
+	"application/zstd":             KindArchive,
+	"application/x-7z-compressed":  KindArchive,
+	"application/vnd.rar":          KindArchive,
+	"application/x-rar-compressed": KindArchive,
+}
+
+// Kind returns the kind of the files of media type t.
+func Kind(t string) string {
+	if kind, ok := kinds[t]; ok {
+		return kind
+	}
+	return KindGeneric
+}
+
+// Processors is the table routing each kind of file to its processor.
+type Processors map[string]Processor
+
+// NewProcessors returns the processor of every kind, sharing builder. Archives are
+// compressed already, they are copied as is like the generic files.
+func NewProcessors(builder Builder) Processors {
+	file := NewFileReader(builder)
+	return Processors{
+		KindImage:    NewImageReader(builder),
+		KindDocument: NewDocumentReader(builder),
+		KindArchive:  file,
+		KindGeneric:  file,
+	}
+}
+
+// For returns the processor of the files of media type t.
+func (p Processors) For(t string) Processor {
+	return p[Kind(t)]
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
+)
+
+// RestoreOptions how Restore brings a backup back.
+type RestoreOptions struct {
+	// To restores into this folder instead of the original location.
+	To string
+	// At restores the state at this time from the versions and snapshots, zero
+	// restores the current backups.
+	At time.Time
+	// Force overwrites local files newer than the restored backup.
+	Force bool
+}
+
+// Restored is the outcome of restoring one file.
+type Restored struct {
+	Backup string
+	Dest   string
+	// Skipped why the file was not restored, empty when it was.
+	Skipped string
+}
+
+// UpToDate the Skipped reason of a local file already matching its backup.
+const UpToDate = "up to date"
+
+// candidate is one copy of a file in the backup drive, backed up at t.
+type candidate struct {
+	path string
+	t    time.Time
+}
+
+// Restore copies the backups of source, a file or a directory below a watched path
+// or the watched path itself, back to their local location, along with the metadata
+// the backups preserved.
+func (i *File) Restore(source string, opt RestoreOptions) ([]Restored, error) {
+	p, ok := config.FileSystemCfg.Find(source)
+	if !ok {
+		return nil, fmt.Errorf("%s is not below a watched path", source)
+	}
+	rel := strings.TrimPrefix(source[len(p.Path):], string(filepath.Separator))
+
+	dst := source
+	if opt.To != "" {
+		dst = filepath.Join(opt.To, filepath.Base(source))
+	}
+
+	files := make(map[string][]candidate)
+	collect(files, filepath.Join(p.BackupFolder(), p.Namespace(), rel), time.Time{})
+	if !opt.At.IsZero() {
+		if snap, ok := snapshotAt(p.BackupFolder(), opt.At); ok {
+			root := filepath.Join(p.BackupFolder(), config.SnapshotsFolder, snap.Format(snapshotLayout), p.Namespace(), rel)
+			collect(files, root, snap)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no backup of %s", source)
+	}
+
+	var restored []Restored
+	for name, list := range files {
+		c, ok := pick(list, opt.At)
+		if !ok {
+			continue
+		}
+		r := Restored{Backup: c.path, Dest: filepath.Join(dst, name)}
+		r.Skipped = i.restore(c.path, r.Dest, opt.Force)
+		restored = append(restored, r)
+	}
+	if len(restored) == 0 {
+		return nil, fmt.Errorf("no backup of %s at %s", source, opt.At.Format(time.RFC3339))
+	}
+	return restored, nil
+}
+
+// collect adds the files below root, a file or a directory, and their versions to
+// files keyed by their path relative to root. at is the time of the files of a
+// snapshot, zero for the current backups.
+func collect(files map[string][]candidate, root string, at time.Time) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		// only versions are left of a replaced or deleted file
+		addVersions(files, filepath.Dir(root), filepath.Base(root), "")
+		return
+	}
+	if !fi.IsDir() {
+		files[""] = append(files[""], candidate{root, backupTime(root, fi, at)})
+		addVersions(files, filepath.Dir(root), fi.Name(), "")
+		return
+	}
+
+	_ = filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if name != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, name)
+		if d.IsDir() {
+			addVersions(files, name, "", rel)
+			return nil
+		}
+		if fi, err := d.Info(); err == nil && fi.Mode().IsRegular() {
+			files[rel] = append(files[rel], candidate{name, backupTime(name, fi, at)})
+		}
+		return nil
+	})
+}
+
+// addVersions adds the versions kept in dir, only those of the file only when it is
+// set, keyed below the relative folder rel.
+func addVersions(files map[string][]candidate, dir, only, rel string) {
+	entries, err := os.ReadDir(filepath.Join(dir, versionsFolder))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		file, t, ok := parseVersion(e.Name())
+		if e.IsDir() || !ok || (only != "" && file != only) {
+			continue
+		}
+		key := filepath.Join(rel, file)
+		if only != "" {
+			key = ""
+		}
+		files[key] = append(files[key], candidate{filepath.Join(dir, versionsFolder, e.Name()), t})
+	}
+}
+
+// backupTime returns when the backup at name was made: at for a snapshot, else the
+// time in the manifest or its modification time when the manifest is not open.
+func backupTime(name string, fi os.FileInfo, at time.Time) time.Time {
+	if !at.IsZero() {
+		return at
+	}
+	if e, ok := manifest.ByBackup(name); ok {
+		return e.BackupTime
+	}
+	return fi.ModTime()
+}
+
+// snapshotAt returns the newest snapshot in folder taken at or before at.
+func snapshotAt(folder string, at time.Time) (time.Time, bool) {
+	var found time.Time
+	for _, t := range snapshots(folder) {
+		if !t.After(at) && t.After(found) {
+			found = t
+		}
+	}
+	return found, !found.IsZero()
+}
+
+// pick returns the newest copy backed up at or before at, with a zero at the
+// current backup.
+func pick(list []candidate, at time.Time) (candidate, bool) {
+	var found candidate
+	for _, c := range list {
+		if at.IsZero() {
+			if !strings.Contains(c.path, string(filepath.Separator)+versionsFolder+string(filepath.Separator)) {
+				return c, true
+			}
+			continue
+		}
+		if !c.t.After(at) && (found.path == "" || c.t.After(found.t)) {
+			found = c
+		}
+	}
+	return found, found.path != ""
+}
+
+// restore copies the backup at backupPath to dst, returning why it was skipped. The
+// local file is compared with the source as the manifest recorded it, the backup
+// may be compressed or carry the time it was copied.
+func (i *File) restore(backupPath, dst string, force bool) string {
+	fi, err := os.Stat(backupPath)
+	if err != nil {
+		return err.Error()
+	}
+	size, modTime := fi.Size(), fi.ModTime()
+	e, recorded := manifest.ByBackup(backupPath)
+	if recorded {
+		size, modTime = e.Size, e.ModTime
+	}
+	if local, err := os.Stat(dst); err == nil {
+		if local.Size() == size && local.ModTime().Equal(modTime) {
+			return UpToDate
+		}
+		if !force && local.ModTime().After(modTime) {
+			return "local file is newer, use --force to overwrite it"
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err.Error()
+	}
+	if err := restoreFile(backupPath, dst); err != nil {
+		return err.Error()
+	}
+	if err := i.builder.preserve(backupPath, dst); err != nil {
+		logger.Warn().Err(err).Str("path", dst).Msg("restore metadata")
+	}
+	if recorded {
+		// the restored file gets the time of the source back
+		if err := os.Chtimes(dst, accessTime(fi), modTime); err != nil {
+			logger.Warn().Err(err).Str("path", dst).Msg("restore modification time")
+		}
+	}
+	return ""
+}
+
+// restoreFile replaces dst with the content of backupPath through a temporary file.
+func restoreFile(backupPath, dst string) error {
+	f, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp, err := tempName(dst)
+	if err != nil {
+		return err
+	}
+	_, err = writeSync(tmp, f)
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+)
+
+// PruneVersions removes the versions of every watched path its retention does not
+// keep. With retention dry_run enabled they are only logged.
+func (i *File) PruneVersions() error {
+	for _, p := range config.FileSystemCfg.Paths {
+		r := p.GetRetention()
+		if !r.Enabled() {
+			continue
+		}
+
+		root := filepath.Join(p.BackupFolder(), p.Namespace())
+		err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() && d.Name() == versionsFolder {
+				return i.pruneVersions(name, r)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneVersions applies r to the versions in the versions folder dir.
+func (i *File) pruneVersions(dir string, r config.RetentionConfig) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string][]Version)
+	for _, e := range entries {
+		file, t, ok := parseVersion(e.Name())
+		if e.IsDir() || !ok {
+			continue
+		}
+		files[file] = append(files[file], Version{Path: filepath.Join(dir, e.Name()), Time: t})
+	}
+
+	now := time.Now()
+	for _, versions := range files {
+		for _, v := range prune(versions, r, now) {
+			if r.DryRun {
+				logger.Info(0).Str("path", v.Path).Time("backup_time", v.Time).Msg("dry run, version would be pruned")
+				continue
+			}
+			if err := i.builder.remove(v.Path); err != nil {
+				return err
+			}
+			logger.Info(0).Str("path", v.Path).Time("backup_time", v.Time).Msg("version pruned")
+		}
+	}
+	return nil
+}
+
+// prune returns the versions of one file r does not keep at now.
+func prune(versions []Version, r config.RetentionConfig, now time.Time) []Version {
+	// newest first
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Time.After(versions[j].Time) })
+
+	keep := make([]bool, len(versions))
+	if r.KeepLast == 0 && r.KeepDaily == 0 && r.KeepWeekly == 0 && r.KeepMonthly == 0 {
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+	for i := 0; i < r.KeepLast && i < len(versions); i++ {
+		keep[i] = true
+	}
+
+	periods := []struct {
+		n   int
+		key func(t time.Time) int
+	}{
+		{r.KeepDaily, func(t time.Time) int { return t.Year()*1000 + t.YearDay() }},
+		{r.KeepWeekly, func(t time.Time) int { y, w := t.ISOWeek(); return y*100 + w }},
+		{r.KeepMonthly, func(t time.Time) int { return t.Year()*100 + int(t.Month()) }},
+	}
+	for _, period := range periods {
+		last, kept := -1, 0
+		for i, v := range versions {
+			if kept == period.n {
+				break
+			}
+			// the newest version of each period
+			if k := period.key(v.Time); k != last {
+				last = k
+				keep[i] = true
+				kept++
+			}
+		}
+	}
+
+	var pruned []Version
+	for i, v := range versions {
+		if !keep[i] || (r.MaxAge > 0 && now.Sub(v.Time) > r.MaxAge) {
+			pruned = append(pruned, v)
+		}
+	}
+	return pruned
+}
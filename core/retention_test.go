@@ -0,0 +1,155 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+)
+
+func day(year int, month time.Month, d, hour int) time.Time {
+	return time.Date(year, month, d, hour, 0, 0, 0, time.UTC)
+}
+
+func TestPrune(t *testing.T) {
+	now := day(2024, 6, 1, 12)
+	tests := []struct {
+		name     string
+		r        config.RetentionConfig
+		versions []time.Time
+		pruned   []time.Time
+	}{
+		{
+			name:     "no rule keeps all",
+			r:        config.RetentionConfig{MaxAge: 365 * 24 * time.Hour},
+			versions: []time.Time{day(2024, 5, 1, 0), day(2024, 4, 1, 0)},
+		},
+		{
+			name:     "keep last",
+			r:        config.RetentionConfig{KeepLast: 2},
+			versions: []time.Time{day(2024, 5, 1, 0), day(2024, 5, 4, 0), day(2024, 5, 2, 0), day(2024, 5, 3, 0)},
+			pruned:   []time.Time{day(2024, 5, 2, 0), day(2024, 5, 1, 0)},
+		},
+		{
+			name: "daily keeps the newest of each day",
+			r:    config.RetentionConfig{KeepDaily: 2},
+			versions: []time.Time{
+				day(2024, 5, 1, 10), day(2024, 5, 1, 12), day(2024, 5, 2, 9),
+				day(2024, 5, 3, 8), day(2024, 5, 3, 20),
+			},
+			pruned: []time.Time{day(2024, 5, 3, 8), day(2024, 5, 1, 12), day(2024, 5, 1, 10)},
+		},
+		{
+			name: "weekly",
+			r:    config.RetentionConfig{KeepWeekly: 2},
+			// mondays 3, 10 and 17 june
+			versions: []time.Time{
+				day(2024, 6, 3, 0), day(2024, 6, 5, 0), day(2024, 6, 10, 0),
+				day(2024, 6, 12, 0), day(2024, 6, 17, 0),
+			},
+			pruned: []time.Time{day(2024, 6, 10, 0), day(2024, 6, 5, 0), day(2024, 6, 3, 0)},
+		},
+		{
+			name: "weekly across the year",
+			r:    config.RetentionConfig{KeepWeekly: 2},
+			// 31 december 2020 and 3 january 2021 share week 53 of 2020
+			versions: []time.Time{day(2020, 12, 31, 0), day(2021, 1, 3, 0), day(2021, 1, 4, 0)},
+			pruned:   []time.Time{day(2020, 12, 31, 0)},
+		},
+		{
+			name: "monthly",
+			r:    config.RetentionConfig{KeepMonthly: 2},
+			versions: []time.Time{
+				day(2024, 4, 10, 0), day(2024, 4, 20, 0), day(2024, 5, 5, 0),
+				day(2024, 5, 25, 0), day(2024, 6, 1, 0),
+			},
+			pruned: []time.Time{day(2024, 5, 5, 0), day(2024, 4, 20, 0), day(2024, 4, 10, 0)},
+		},
+		{
+			name: "any rule keeps",
+			r:    config.RetentionConfig{KeepLast: 1, KeepMonthly: 3},
+			versions: []time.Time{
+				day(2024, 4, 10, 0), day(2024, 4, 20, 0), day(2024, 5, 5, 0),
+				day(2024, 5, 25, 0), day(2024, 6, 1, 0),
+			},
+			pruned: []time.Time{day(2024, 5, 5, 0), day(2024, 4, 10, 0)},
+		},
+		{
+			name:     "max age prunes kept versions",
+			r:        config.RetentionConfig{KeepLast: 5, MaxAge: 48 * time.Hour},
+			versions: []time.Time{day(2024, 5, 31, 12), day(2024, 5, 29, 12)},
+			pruned:   []time.Time{day(2024, 5, 29, 12)},
+		},
+		{
+			name:     "more rules than versions",
+			r:        config.RetentionConfig{KeepLast: 10, KeepDaily: 10, KeepWeekly: 10, KeepMonthly: 10},
+			versions: []time.Time{day(2024, 5, 31, 12), day(2024, 1, 1, 0)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var versions []Version
+			for _, v := range tt.versions {
+				versions = append(versions, Version{Path: v.String(), Time: v})
+			}
+
+			pruned := prune(versions, tt.r, now)
+			if len(pruned) != len(tt.pruned) {
+				t.Fatalf("pruned %v, want %v", pruned, tt.pruned)
+			}
+			for i, v := range pruned {
+				if !v.Time.Equal(tt.pruned[i]) {
+					t.Fatalf("pruned %v, want %v", pruned, tt.pruned)
+				}
+			}
+		})
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	at := time.Date(2024, 6, 1, 10, 20, 30, 0, time.Local)
+	stamp := at.Format(versionLayout)
+	tests := []struct {
+		name string
+		file string
+		ok   bool
+	}{
+		{"report." + stamp + ".pdf", "report.pdf", true},
+		{"archive.tar." + stamp + ".gz", "archive.tar.gz", true},
+		{"v1.2." + stamp + ".3", "v1.2.3", true},
+		{"my.notes.v2." + stamp + ".txt", "my.notes.v2.txt", true},
+		{"README." + stamp, "README", true},
+		{"." + stamp + ".bashrc", ".bashrc", true},
+		{"report.pdf", "", false},
+		{"README", "", false},
+		{stamp, "", false},
+		{"." + stamp, "", false},
+		{"report.2024-13-01T10-20-30.pdf", "", false},
+		{"report-" + stamp + ".pdf", "", false},
+	}
+	for _, tt := range tests {
+		file, got, ok := parseVersion(tt.name)
+		if ok != tt.ok || file != tt.file {
+			t.Errorf("parseVersion(%q) = %q, %v, want %q, %v", tt.name, file, ok, tt.file, tt.ok)
+			continue
+		}
+		if ok && !got.Equal(at) {
+			t.Errorf("parseVersion(%q) time = %v, want %v", tt.name, got, at)
+		}
+	}
+}
+
+func TestVersionPathRoundTrip(t *testing.T) {
+	at := time.Date(2024, 6, 1, 10, 20, 30, 0, time.Local)
+	for _, name := range []string{"report.pdf", "archive.tar.gz", "v1.2.3", "README", ".bashrc", "a b.txt"} {
+		v := versionPath(filepath.Join("backup", name), at)
+		if dir := filepath.Base(filepath.Dir(v)); dir != versionsFolder {
+			t.Errorf("versionPath(%q) = %q, not in %s", name, v, versionsFolder)
+		}
+		file, got, ok := parseVersion(filepath.Base(v))
+		if !ok || file != name || !got.Equal(at) {
+			t.Errorf("parseVersion(%q) = %q, %v, %v, want %q", filepath.Base(v), file, got, ok, name)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/manifest"
+	"github.com/hinha/watchgo/utils"
+)
+
+// Problems found by Verify.
+const (
+	Missing    = "missing"
+	Corrupted  = "corrupted"
+	Unexpected = "unexpected"
+)
+
+// scrubState the manifest state holding the last backup checked by an unfinished Verify.
+const scrubState = "verify"
+
+// scrubBatch how many entries are checked between two saves of the progress, the
+// results of the entries checked meanwhile being recorded in the same transaction.
+const scrubBatch = 256
+
+// progressInterval how often Verify reports its progress.
+const progressInterval = 10 * time.Second
+
+// hashBufferSize the buffer used to hash the backups.
+const hashBufferSize = 1 << 20
+
+var (
+	errSourceChanged = errors.New("source changed since it was backed up")
+	errNotWatched    = errors.New("source is not below a watched path")
+	errIgnored       = errors.New("source is excluded by the ignore rules")
+)
+
+// VerifyOptions how Verify scrubs the backup drives.
+type VerifyOptions struct {
+	// Restart checks every backup again instead of resuming an unfinished run.
+	Restart bool
+	// Repair copies the corrupted and missing backups again from their source,
+	// when the source still matches the hash the backup was made from.
+	Repair bool
+	// Report receives every problem found.
+	Report func(Problem)
+	// Progress receives the count and size of the backups checked so far, at
+	// most every progressInterval.
+	Progress func(checked int, size int64)
+}
+
+// Problem is one backup that does not match the manifest. An Unexpected file may
+// just predate the manifest.
+type Problem struct {
+	Kind   string
+	Backup string
+	Source string
+	// Repaired whether the backup was copied again, Err why it could not be.
+	Repaired bool
+	Err      error
+}
+
+// Verify hashes every backup in the manifest again and compares it with the hash
+// recorded when it was made, then looks for files in the backup drives the manifest
+// does not know. The position is saved in the manifest along the way, with the
+// result of each check, an interrupted run resumes there unless opt.Restart is set.
+func (i *File) Verify(opt VerifyOptions) (int, error) {
+	after := manifest.State(scrubState)
+	if opt.Restart {
+		after = ""
+	}
+
+	var (
+		checked int
+		size    int64
+		last    = time.Now()
+		buf     = make([]byte, hashBufferSize)
+	)
+	for {
+		entries := manifest.List(after, scrubBatch)
+		if len(entries) == 0 {
+			break
+		}
+
+		scrubbed := make([]manifest.Entry, 0, len(entries))
+		for _, e := range entries {
+			p, ok := i.check(e, buf)
+			if !ok {
+				if opt.Repair {
+					p.Err = i.repair(e)
+					p.Repaired = p.Err == nil
+				}
+				opt.Report(p)
+			}
+			// a repaired backup was recorded anew
+			if !p.Repaired {
+				e.ScrubbedAt, e.ScrubOK = time.Now(), ok
+				scrubbed = append(scrubbed, e)
+			}
+
+			checked++
+			size += e.Size
+			if opt.Progress != nil && time.Since(last) >= progressInterval {
+				opt.Progress(checked, size)
+				last = time.Now()
+			}
+		}
+
+		after = entries[len(entries)-1].Backup
+		if err := manifest.SetScrubbed(scrubbed, scrubState, after); err != nil {
+			return checked, err
+		}
+	}
+
+	if err := unexpected(opt.Report); err != nil {
+		return checked, err
+	}
+	return checked, manifest.SetState(scrubState, "")
+}
+
+// check hashes the backup of e and its derivative.
+func (i *File) check(e manifest.Entry, buf []byte) (Problem, bool) {
+	p := Problem{Backup: e.Backup, Source: e.Source}
+	sum, _, err := utils.HashFile(e.Backup, e.HashAlgo, buf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			p.Kind = Missing
+		} else {
+			p.Kind, p.Err = Corrupted, err
+		}
+		return p, false
+	}
+	if utils.Digest(e.HashAlgo, sum) != e.BackupDigest() {
+		p.Kind = Corrupted
+		return p, false
+	}
+
+	if e.Derivative != "" {
+		p.Backup = e.Derivative
+		sum, _, err := utils.HashFile(e.Derivative, e.HashAlgo, buf)
+		switch {
+		case os.IsNotExist(err):
+			p.Kind = Missing
+			return p, false
+		case err != nil:
+			p.Kind, p.Err = Corrupted, err
+			return p, false
+		case sum != e.DerivativeHash:
+			p.Kind = Corrupted
+			return p, false
+		}
+	}
+
+	return p, true
+}
+
+// repair copies the source of e again when it still holds the content e was backed
+// up from. A processed backup, or one with a derivative, goes through the image
+// processing again.
+func (i *File) repair(e manifest.Entry) error {
+	sum, _, err := utils.HashFile(e.Source, e.HashAlgo, nil)
+	if err != nil {
+		return err
+	}
+	if sum != e.Hash {
+		return errSourceChanged
+	}
+
+	p, ok := config.FileSystemCfg.Find(e.Source)
+	if !ok {
+		return errNotWatched
+	}
+	subPath := []string{p.Path, e.Source[len(p.Path):]}
+	// the source did not change, nor did its type
+	t := utils.NewMediaType(e.Source, e.Type)
+	fi, err := os.Stat(e.Source)
+	if err != nil {
+		return err
+	}
+	if utils.IgnoreFile(e.Source, e.Source, fi, t) {
+		return errIgnored
+	}
+	if e.Derivative != "" || (e.BackupHash != "" && e.BackupHash != e.Hash) {
+		return NewImageReader(i.builder).Open(e.Source, subPath, t.Get())
+	}
+	return NewProcessors(i.builder).For(t.Get()).Open(e.Source, subPath, t.Get())
+}
+
+// unexpected reports the files in the watched paths of the backup drives that have
+// no manifest entry.
+func unexpected(report func(Problem)) error {
+	for _, p := range config.FileSystemCfg.Paths {
+		root := filepath.Join(p.BackupFolder(), p.Namespace())
+		err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if name != root && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() {
+				if _, ok := manifest.ByBackup(name); !ok {
+					source, _ := SourcePath(name)
+					report(Problem{Kind: Unexpected, Backup: name, Source: source})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
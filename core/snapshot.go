@@ -0,0 +1,166 @@
+package core
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+)
+
+// snapshotLayout the layout of the time naming a snapshot, when it was taken.
+const snapshotLayout = versionLayout
+
+// partialSuffix marks a snapshot still being linked, removed if a crash left it behind.
+const partialSuffix = ".partial"
+
+// Snapshot materializes the backups of every watched path at t under
+// "Backup Files/snapshots/<t>/<namespace>". The snapshot files are hard links to
+// the backups, which are replaced and never written through, so the files left
+// unchanged since the previous snapshot share their storage with it.
+func (i *File) Snapshot(t time.Time) error {
+	duration := time.Now()
+	name := t.Format(snapshotLayout)
+	if config.DryRun {
+		logger.Info(0).Str("snapshot", name).Msg("dry run, take snapshot")
+		return nil
+	}
+	if err := i.cleanPartial(); err != nil {
+		return err
+	}
+
+	// linked into a hidden folder first, a snapshot only shows up complete
+	partials := make(map[string]string)
+	for _, p := range config.FileSystemCfg.Paths {
+		dir := filepath.Join(p.BackupFolder(), config.SnapshotsFolder)
+		partial := filepath.Join(dir, "."+name+partialSuffix)
+		partials[partial] = filepath.Join(dir, name)
+		if err := os.MkdirAll(partial, os.ModePerm); err != nil {
+			return err
+		}
+
+		if err := linkTree(filepath.Join(p.BackupFolder(), p.Namespace()), filepath.Join(partial, p.Namespace())); err != nil {
+			return err
+		}
+	}
+
+	for partial, dst := range partials {
+		if err := os.Rename(partial, dst); err != nil {
+			return err
+		}
+	}
+	logger.Info(time.Since(duration)).Str("snapshot", name).Msg("snapshot taken")
+	return nil
+}
+
+// linkTree links every file below src into the same place below dst, skipping the
+// hidden entries: versions, trash, objects and partial copies.
+func linkTree(src, dst string) error {
+	return filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == src {
+				return nil
+			}
+			return err
+		}
+		if name != src && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, _ := filepath.Rel(src, name)
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if err := os.Link(name, target); err != nil {
+			// the drive has no hard links, keep a plain copy
+			logger.Debug().Err(err).Str("path", target).Msg("link snapshot")
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = writeSync(target, f)
+			return err
+		}
+		return nil
+	})
+}
+
+// cleanPartial removes the snapshots an interrupted Snapshot left behind.
+func (i *File) cleanPartial() error {
+	for _, folder := range config.BackupFolders() {
+		partials, err := filepath.Glob(filepath.Join(folder, config.SnapshotsFolder, ".*"+partialSuffix))
+		if err != nil {
+			return err
+		}
+		for _, partial := range partials {
+			if err := i.builder.remove(partial); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshots returns the times of the snapshots in every backup folder, oldest first.
+func Snapshots() []time.Time {
+	seen := make(map[time.Time]bool)
+	var times []time.Time
+	for _, folder := range config.BackupFolders() {
+		for _, t := range snapshots(folder) {
+			if !seen[t] {
+				seen[t] = true
+				times = append(times, t)
+			}
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+// snapshots returns the times of the snapshots in the backup folder, in name order.
+func snapshots(folder string) []time.Time {
+	entries, _ := os.ReadDir(filepath.Join(folder, config.SnapshotsFolder))
+
+	var times []time.Time
+	for _, e := range entries {
+		t, err := time.ParseInLocation(snapshotLayout, e.Name(), time.Local)
+		if err == nil && e.IsDir() {
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
+// PruneSnapshots removes the oldest snapshots of every backup folder beyond the
+// newest keep, zero keeps them all.
+func (i *File) PruneSnapshots(keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	for _, folder := range config.BackupFolders() {
+		times := snapshots(folder)
+		for len(times) > keep {
+			name := filepath.Join(folder, config.SnapshotsFolder, times[0].Format(snapshotLayout))
+			if err := i.builder.remove(name); err != nil {
+				return err
+			}
+			times = times[1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/manifest"
+)
+
+// trashFolder keeps the backups of deleted files, one folder per day.
+const trashFolder = ".trash"
+
+// trashDay the layout naming each day in the trash.
+const trashDay = "2006-01-02"
+
+// Remove applies the backup on_delete policy to backupPath, whose local file or
+// directory was deleted.
+func (i *File) Remove(backupPath string) error {
+	if _, err := os.Stat(backupPath); err != nil {
+		return err
+	}
+
+	var err error
+	switch config.FileSystemCfg.Backup.OnDelete {
+	case config.OnDeleteMirror:
+		err = i.builder.remove(backupPath)
+	case config.OnDeleteTrash:
+		err = i.builder.rename(backupPath, trashPath(backupPath, time.Now()))
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	if err := i.removeDerivative(backupPath); err != nil {
+		return err
+	}
+	return manifest.Delete(backupPath)
+}
+
+// EmptyTrash deletes the days in the trash of every drive older than the backup
+// trash_retention, a zero retention keeps them forever.
+func (i *File) EmptyTrash() error {
+	retention := config.FileSystemCfg.Backup.TrashRetention
+	if retention <= 0 {
+		return nil
+	}
+
+	for _, folder := range config.BackupFolders() {
+		if err := i.emptyTrash(path.Join(folder, trashFolder), retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *File) emptyTrash(dir string, retention time.Duration) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		day, err := time.ParseInLocation(trashDay, e.Name(), time.Local)
+		if err != nil || time.Since(day) < retention {
+			continue
+		}
+		if err := i.builder.remove(path.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashPath returns where backupPath goes in the trash of day t, keeping its place
+// in the backup tree.
+func trashPath(backupPath string, t time.Time) string {
+	base := backupRoot(backupPath)
+	rel, _ := filepath.Rel(base, backupPath)
+
+	dst := filepath.Join(base, trashFolder, t.Format(trashDay), rel)
+	if _, err := os.Stat(dst); err == nil {
+		// deleted again the same day
+		ext := filepath.Ext(dst)
+		dst = dst[:len(dst)-len(ext)] + t.Format(".150405") + ext
+	}
+	return dst
+}
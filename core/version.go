@@ -0,0 +1,133 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
+	"github.com/hinha/watchgo/utils"
+)
+
+// versionsFolder keeps the previous backups of the files in its folder when backup
+// versions is enabled, report.pdf becoming .versions/report.<time>.pdf.
+const versionsFolder = ".versions"
+
+// versionLayout the layout of the time naming a version, when it was backed up.
+const versionLayout = "2006-01-02T15-04-05"
+
+// Version is a previous backup of a file.
+type Version struct {
+	Path string
+	Time time.Time
+	Size int64
+}
+
+// keepVersion links the backup at dstPath into its versions folder, or copies it
+// on drives without hard links, before it is replaced by the content summed to sum.
+// Nothing is kept when the content did not change or versioning is disabled.
+func keepVersion(dstPath, sum string) error {
+	if !config.FileSystemCfg.Backup.Versions {
+		return nil
+	}
+
+	fi, err := os.Stat(dstPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	t := fi.ModTime()
+	if e, ok := manifest.ByBackup(dstPath); ok {
+		if e.HashAlgo == config.FileSystemCfg.Hash && e.Hash == sum {
+			return nil
+		}
+		t = e.BackupTime
+	} else if prev, _, err := utils.HashFile(dstPath, config.FileSystemCfg.Hash, nil); err == nil && prev == sum {
+		return nil
+	}
+
+	dst := versionPath(dstPath, t)
+	if err := cloneFile(dstPath, dst); err != nil {
+		return err
+	}
+	logger.Debug().Str("path", dstPath).Str("version", dst).Msg("keep version")
+	return nil
+}
+
+// versionPath returns the name of the version of dstPath backed up at t.
+func versionPath(dstPath string, t time.Time) string {
+	name := filepath.Base(dstPath)
+	ext := filepath.Ext(name)
+	return filepath.Join(filepath.Dir(dstPath), versionsFolder, strings.TrimSuffix(name, ext)+"."+t.Format(versionLayout)+ext)
+}
+
+// parseVersion is the inverse of versionPath, it returns the name of the file a
+// version belongs to and when the version was backed up.
+func parseVersion(name string) (string, time.Time, bool) {
+	// without extension first, the time holds no dot. The version of a dot file such
+	// as .bashrc is the time followed by its name.
+	for _, ext := range []string{"", filepath.Ext(name)} {
+		rest := strings.TrimSuffix(name, ext)
+		i := len(rest) - len(versionLayout) - 1
+		if i < 0 || (i == 0 && ext == "") || rest[i] != '.' {
+			continue
+		}
+		t, err := time.ParseInLocation(versionLayout, rest[i+1:], time.Local)
+		if err != nil {
+			continue
+		}
+		return rest[:i] + ext, t, true
+	}
+	return "", time.Time{}, false
+}
+
+// BackupOf returns where the backup of the local file source is stored, false when
+// it is not below a watched path.
+func BackupOf(source string) (string, bool) {
+	p, ok := config.FileSystemCfg.Find(source)
+	if !ok || source == p.Path {
+		return "", false
+	}
+	return BackupPath([]string{p.Path, source[len(p.Path):]}), true
+}
+
+// Versions returns the previous backups of the local file source, oldest first.
+func Versions(source string) ([]Version, error) {
+	dstPath, ok := BackupOf(source)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	dir := filepath.Join(filepath.Dir(dstPath), versionsFolder)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	name := filepath.Base(dstPath)
+	var versions []Version
+	for _, e := range entries {
+		file, t, ok := parseVersion(e.Name())
+		if e.IsDir() || !ok || file != name {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, Version{Path: filepath.Join(dir, e.Name()), Time: t, Size: fi.Size()})
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Time.Before(versions[j].Time) })
+	return versions, nil
+}
@@ -0,0 +1,113 @@
+package fswatch
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/manifest"
+)
+
+// Kinds of Difference.
+const (
+	SourceOnly = "source_only"
+	BackupOnly = "backup_only"
+	Changed    = "changed"
+)
+
+// Difference is one file that does not match between a watched path and its backup.
+type Difference struct {
+	Kind   string `json:"kind"`
+	Source string `json:"source,omitempty"`
+	Backup string `json:"backup,omitempty"`
+}
+
+// Diff compares the watched path index with its backup through the same walkers as
+// the janitor, without copying anything. Differences are ordered by path. Without a
+// manifest a backup cannot be told from a compressed one, only the presence of the
+// files is compared then. Read errors are returned along the differences found.
+func Diff(index int) ([]Difference, error) {
+	path := config.FileSystemCfg.Paths[index].Path
+	if !exists(path) {
+		return nil, fmt.Errorf("watch path %s not found", path)
+	}
+
+	w := &FSWatcher{syncDone: make(chan struct{})}
+	defer close(w.syncDone)
+
+	compare := manifest.Opened()
+	drive := make(chan resultSync)
+	driveErr := make(chan error, 1)
+	if compare {
+		w.hardDrive(index, drive, driveErr)
+	} else {
+		go walkDir(w.syncDone, drive, driveErr, backupRoot(index), false, unread)
+	}
+
+	// backup path -> sum
+	byPath := make(map[string]string)
+	var errs []error
+	for r := range drive {
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		byPath[r.path] = r.sum
+	}
+	if err := <-driveErr; err != nil {
+		return nil, err
+	}
+
+	var diff []Difference
+	local := make(chan resultSync)
+	localErr := make(chan error, 1)
+	if compare {
+		w.localDrive(path, index, local, localErr)
+	} else {
+		go walkDir(w.syncDone, local, localErr, path, true, unread)
+	}
+	for r := range local {
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+
+		dst := core.BackupPath([]string{path, r.path[len(path):]})
+		sum, ok := byPath[dst]
+		switch {
+		case !ok:
+			diff = append(diff, Difference{Kind: SourceOnly, Source: r.path})
+		case compare && sum != r.sum:
+			diff = append(diff, Difference{Kind: Changed, Source: r.path, Backup: dst})
+		}
+		delete(byPath, dst)
+	}
+	if err := <-localErr; err != nil {
+		return nil, err
+	}
+
+	for v := range byPath {
+		src, _ := core.SourcePath(v)
+		diff = append(diff, Difference{Kind: BackupOnly, Source: src, Backup: v})
+	}
+
+	sort.Slice(diff, func(i, j int) bool { return diff[i].key() < diff[j].key() })
+	if len(errs) > 0 {
+		return diff, fmt.Errorf("%d files could not be read, first: %w", len(errs), errs[0])
+	}
+	return diff, nil
+}
+
+// unread leaves the files of a walk unread, their content not being compared.
+func unread(string, fs.FileInfo) (string, string) {
+	return config.FileSystemCfg.Hash, "-"
+}
+
+func (d Difference) key() string {
+	if d.Source != "" {
+		return d.Source
+	}
+	return d.Backup
+}
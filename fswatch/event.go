@@ -3,11 +3,15 @@ package fswatch
 import (
 	"context"
 	"github.com/fsnotify/fsnotify"
-	"regexp"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/core"
+	"github.com/hinha/watchgo/logger"
 	"github.com/hinha/watchgo/utils"
 )
 
@@ -15,62 +19,146 @@ import (
 type ProcessEvent struct {
 	ctx context.Context
 
-	image *core.Image
-	file  *core.File
+	processors core.Processors
+	file       *core.File
+
+	mu      sync.Mutex
+	pending map[string]*time.Timer
+	ready   chan string
 }
 
 // NewEvent cmd wrapper.
 func NewEvent(ctx context.Context) *ProcessEvent {
 	return &ProcessEvent{
-		ctx: ctx,
+		ctx:     ctx,
+		pending: make(map[string]*time.Timer),
 	}
 }
 
 func (p *ProcessEvent) Run(event chan fsnotify.Event) {
 	builder := core.NewBuilder()
-	p.image = core.NewImageReader(builder)
+	p.processors = core.NewProcessors(builder)
 	p.file = core.NewFileReader(builder)
+	p.ready = make(chan string, config.General.WorkerBuffer)
 	for i := 0; i < config.General.Worker; i++ {
 		go p.process(event)
 	}
 }
 
 func (p *ProcessEvent) process(event chan fsnotify.Event) {
-	reImage, err := regexp.Compile(core.Regexp())
-	if err != nil {
-		return
-	}
 	for {
 		select {
 		case evt := <-event:
-			if evt.Op&(fsnotify.Create) > 0 {
+			if evt.Op&(fsnotify.Create|fsnotify.Write) > 0 {
 				if strings.HasSuffix(evt.Name, "~") {
 					evt.Name = evt.Name[:len(evt.Name)-1]
 				}
 
-				if utils.IgnoreExtension(evt.Name) {
+				if config.General.Debounce <= 0 {
+					p.backup(evt.Name)
 					continue
 				}
-
-				fsp := strings.SplitAfterN(evt.Name, "/", -1)
-				fxt := strings.Join(fsp[len(fsp)-1:], "")
-				fd := strings.Join(fsp[:len(fsp)-1], "")
-				var subFolder string
-				if len(fd) > 1 {
-					subFolder = fd[:len(fd)-1]
-				} else {
-					subFolder = ""
-				}
-
-				subPath := []string{subFolder, fxt}
-				if reImage.MatchString(evt.Name) {
-					_ = p.image.Open(evt.Name, subPath)
-				} else {
-					_ = p.file.Open(evt.Name, subPath)
-				}
+				p.debounce(evt.Name, config.General.Debounce)
+			} else if evt.Op&(fsnotify.Remove|fsnotify.Rename) > 0 {
+				p.remove(evt.Name)
 			}
+		case name := <-p.ready:
+			p.backup(name)
 		case <-p.ctx.Done():
 			return
 		}
 	}
 }
+
+// debounce queues name for backup once no Create or Write event has been seen
+// for it during delay, so a file written in many chunks is copied once.
+func (p *ProcessEvent) debounce(name string, delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.pending[name]; ok && t.Stop() {
+		t.Reset(delay)
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		if p.pending[name] == t {
+			delete(p.pending, name)
+		}
+		p.mu.Unlock()
+
+		select {
+		case p.ready <- name:
+		case <-p.ctx.Done():
+		}
+	})
+	p.pending[name] = t
+}
+
+// remove applies the on_delete policy to the backup of name, which left the watched paths.
+func (p *ProcessEvent) remove(name string) {
+	p.mu.Lock()
+	if t, ok := p.pending[name]; ok {
+		t.Stop()
+		delete(p.pending, name)
+	}
+	p.mu.Unlock()
+
+	if config.FileSystemCfg.Backup.OnDelete == config.OnDeleteIgnore {
+		return
+	}
+
+	subPath, ok := splitRoot(name)
+	if !ok {
+		return
+	}
+
+	if err := p.file.Remove(core.BackupPath(subPath)); err != nil && !os.IsNotExist(err) {
+		logger.Error().Err(err).Str("path", name).Msg("remove backup")
+	}
+}
+
+// backup copies name into the backup drive. Hidden files, and the files of hidden
+// directories, are left out as the janitor leaves them out.
+func (p *ProcessEvent) backup(name string) {
+	stat, err := os.Stat(name)
+	if err != nil || stat.IsDir() {
+		return
+	}
+	subPath, ok := splitRoot(name)
+	if !ok || hiddenBelow(subPath) {
+		return
+	}
+	t := utils.NewMediaType(name, "")
+	if utils.IgnoreFile(name, name, stat, t) {
+		return
+	}
+
+	if err := p.processors.For(t.Get()).Open(name, subPath, t.Get()); err != nil {
+		logger.Error().Err(err).Str("kind", core.Kind(t.Get())).Msg("file backup")
+	}
+}
+
+// hiddenBelow reports whether the file of subPath, or a directory between it and the
+// watched path, is hidden.
+func hiddenBelow(subPath []string) bool {
+	root := subPath[0]
+	for name := root + subPath[1]; len(name) > len(root); name = filepath.Dir(name) {
+		if ok, _ := utils.IsHiddenFile(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRoot splits name into the watched path containing it and the remainder,
+// the same shape the janitor passes to core.
+func splitRoot(name string) ([]string, bool) {
+	p, ok := config.FileSystemCfg.Find(name)
+	if !ok || name == p.Path {
+		return nil, false
+	}
+	return []string{p.Path, name[len(p.Path):]}, true
+}
@@ -2,17 +2,15 @@ package fswatch
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
 	"io/fs"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -20,19 +18,34 @@ import (
 	"github.com/hinha/watchgo/config"
 	"github.com/hinha/watchgo/core"
 	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/manifest"
 	"github.com/hinha/watchgo/utils"
 )
 
-// intervalDuration sync every 30 minutes.
-var intervalDuration = 30 * time.Minute
+var (
+	// intervalDuration sync every 30 minutes.
+	intervalDuration = 30 * time.Minute
+	// renameWindow how long a Rename event waits for the Create of the new name.
+	renameWindow = time.Second
+)
 
 type FSWatcher struct {
 	w      *fsnotify.Watcher
 	Events chan fsnotify.Event
 
-	syncDone chan struct{}
-	image    *core.Image
-	file     *core.File
+	syncDone   chan struct{}
+	processors core.Processors
+	file       *core.File
+
+	mu      sync.Mutex
+	renamed *fsnotify.Event
+	// renamedDir whether the renamed path was a watched directory.
+	renamedDir bool
+	timer      *time.Timer
+
+	dirsMu sync.Mutex
+	// dirs the watched directories, so removing a file does not scan the watch list.
+	dirs map[string]bool
 }
 
 func janitor(ctx context.Context, w *FSWatcher, interval time.Duration) {
@@ -53,8 +66,19 @@ func janitor(ctx context.Context, w *FSWatcher, interval time.Duration) {
 
 			starTime := time.Now()
 			for i, p := range config.FileSystemCfg.Paths {
-				w.syncFile(p, i)
+				w.syncFile(p.Path, i)
+			}
+			if err := w.file.EmptyTrash(); err != nil {
+				logger.Error().Err(err).Msg("empty trash")
+			}
+			if err := w.file.PruneVersions(); err != nil {
+				logger.Error().Err(err).Msg("prune versions")
+			}
+			w.snapshot()
+			if err := w.file.PruneObjects(); err != nil {
+				logger.Error().Err(err).Msg("prune objects")
 			}
+			logger.Debug().Int("watches", w.Watches()).Msg("watching directories")
 
 			// reset interval
 			ticker = time.NewTicker(time.Duration(time.Since(starTime).Seconds()+intervalDuration.Seconds()) * time.Second)
@@ -72,51 +96,307 @@ func (w *FSWatcher) FSWatcherStart(ctx context.Context, watch *fsnotify.Watcher)
 	defer close(w.syncDone)
 
 	builder := core.NewBuilder()
-	w.image = core.NewImageReader(builder)
+	w.processors = core.NewProcessors(builder)
 	w.file = core.NewFileReader(builder)
 
+	if err := w.file.CleanTemp(); err != nil {
+		logger.Error().Err(err).Msg("clean partial copies")
+	}
+
 	starTime := time.Now()
 	for i, p := range config.FileSystemCfg.Paths {
-		w.syncFile(p, i)
-		//go watcherInit(w.FChan, p)
-		go watcherInit(w.w, p)
+		w.syncFile(p.Path, i)
+		w.watcherInit(p.Path)
+	}
+	if err := w.file.EmptyTrash(); err != nil {
+		logger.Error().Err(err).Msg("empty trash")
 	}
+	w.snapshot()
 	logger.Debug().Dur("duration", time.Since(starTime)).Msg("scanning complete")
+	logger.Info(time.Since(starTime)).Int("watches", w.Watches()).Msg("watching directories")
 	go janitor(ctx, w, time.Since(starTime))
 }
 
+// snapshot takes a snapshot of the synced backups when the latest one is older than
+// the snapshot interval, then prunes the snapshots beyond the ones to keep.
+func (w *FSWatcher) snapshot() {
+	s := config.FileSystemCfg.Backup.Snapshot
+	if s.Interval <= 0 {
+		return
+	}
+
+	if times := core.Snapshots(); len(times) > 0 && time.Since(times[len(times)-1]) < s.Interval {
+		return
+	}
+	if err := w.file.Snapshot(time.Now()); err != nil {
+		logger.Error().Err(err).Msg("take snapshot")
+		return
+	}
+	if err := w.file.PruneSnapshots(s.Keep); err != nil {
+		logger.Error().Err(err).Msg("prune snapshots")
+	}
+}
+
 func (w *FSWatcher) FSWatcherStop() {
 	if err := w.w.Close(); err != nil {
 		log.Fatal(err)
 	}
 }
 
-// watcherInit.
-func watcherInit(w *fsnotify.Watcher, path string) {
-	if err := w.Add(path); err != nil {
+// Watches returns the number of directories currently being watched.
+func (w *FSWatcher) Watches() int {
+	return len(w.w.WatchList())
+}
+
+// Track keeps the watch list in sync with the directory tree and forwards ev to c.
+// Directories created or moved into a watched path are registered recursively and
+// the files already inside them are queued as Create events, directories removed
+// or renamed away have their watches dropped. A Rename followed by the Create of
+// the same directory or unchanged file under a new name is applied as a move inside
+// the backup drive, any other Create as the Remove of the old name and a copy.
+func (w *FSWatcher) Track(ev fsnotify.Event, c chan<- fsnotify.Event) {
+	// self events of a watch already dropped come without a name.
+	if ev.Name == "" {
+		return
+	}
+
+	if ev.Op&fsnotify.Rename > 0 {
+		dir := w.removeRecursive(ev.Name) > 0
+		if dir {
+			logger.Debug().Int("watches", w.Watches()).Str("path", ev.Name).Msg("directory removed")
+		}
+		w.holdRename(ev, dir, c)
+		return
+	}
+
+	var moved bool
+	if renamed, dir := w.takeRename(); renamed != nil {
+		moved = ev.Op&fsnotify.Create > 0 && renamedTo(renamed.Name, dir, ev.Name) && w.move(renamed.Name, ev.Name)
+		if !moved {
+			c <- *renamed
+		}
+	}
+
+	if ev.Op&fsnotify.Create > 0 {
+		fi, err := os.Stat(ev.Name)
+		if err == nil && fi.IsDir() {
+			if ok, _ := utils.IsHiddenFile(ev.Name); ok {
+				return
+			}
+
+			// the files of a moved directory changed since their backup, their
+			// events pending under the old name, are copied again
+			found := func(name string) {
+				if !moved || !unchanged(name) {
+					c <- fsnotify.Event{Name: name, Op: fsnotify.Create}
+				}
+			}
+			if err = w.addRecursive(ev.Name, found); err != nil {
+				logger.Error().Err(err).Str("path", ev.Name).Msg("watch directory")
+			}
+			logger.Debug().Int("watches", w.Watches()).Str("path", ev.Name).Msg("directory added")
+			return
+		}
+
+		if moved {
+			return
+		}
+	}
+
+	if ev.Op&fsnotify.Remove > 0 {
+		if w.removeRecursive(ev.Name) > 0 {
+			logger.Debug().Int("watches", w.Watches()).Str("path", ev.Name).Msg("directory removed")
+		}
+	}
+
+	c <- ev
+}
+
+// holdRename keeps ev until the next event, forwarding it to c if nothing pairs with
+// it within renameWindow, meaning the file left the watched paths. dir tells whether
+// ev renamed a watched directory.
+func (w *FSWatcher) holdRename(ev fsnotify.Event, dir bool, c chan<- fsnotify.Event) {
+	if prev, _ := w.takeRename(); prev != nil {
+		c <- *prev
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.renamed, w.renamedDir = &ev, dir
+	w.timer = time.AfterFunc(renameWindow, func() {
+		if prev, _ := w.takeRename(); prev != nil {
+			c <- *prev
+		}
+	})
+}
+
+// takeRename returns the pending Rename event, if any, and whether it renamed a
+// watched directory, and clears it.
+func (w *FSWatcher) takeRename() (*fsnotify.Event, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ev, dir := w.renamed, w.renamedDir
+	if ev != nil {
+		w.timer.Stop()
+		w.renamed, w.renamedDir, w.timer = nil, false, nil
+	}
+	return ev, dir
+}
+
+// renamedTo reports whether newName is oldName under a new name: both directories,
+// or a file of the size and modification time the manifest recorded for oldName.
+func renamedTo(oldName string, dir bool, newName string) bool {
+	fi, err := os.Stat(newName)
+	if err != nil || fi.IsDir() != dir {
+		return false
+	}
+	if dir {
+		return true
+	}
+	e, ok := manifest.Get(oldName)
+	return ok && e.Unchanged(fi)
+}
+
+// unchanged reports whether the file name matches its entry in the manifest.
+func unchanged(name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	e, ok := manifest.Get(name)
+	return ok && e.Unchanged(fi)
+}
+
+// move renames the backup of oldName to the backup location of newName,
+// reporting whether there was a backup to move.
+func (w *FSWatcher) move(oldName, newName string) bool {
+	oldSub, ok := splitRoot(oldName)
+	if !ok {
+		return false
+	}
+	newSub, ok := splitRoot(newName)
+	if !ok {
+		return false
+	}
+
+	if err := w.file.Move(core.BackupPath(oldSub), newSub); err != nil {
+		logger.Debug().Err(err).Str("from", oldName).Str("to", newName).Msg("rename without backup")
+		return false
+	}
+	return true
+}
+
+// watcherInit registers path and every directory below it.
+func (w *FSWatcher) watcherInit(path string) {
+	if err := w.addRecursive(path, nil); err != nil {
 		log.Fatalf("watch path %s error: %s\n", path, err)
 	}
 }
 
-// A resultSync is the product of reading and summing a file using MD5.
+// addRecursive walks root and adds a watch for each directory, skipping hidden ones.
+// Regular files found along the way are passed to found when it is not nil.
+func (w *FSWatcher) addRecursive(root string, found func(name string)) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// the entry disappeared while walking.
+			return nil
+		}
+
+		if path != root {
+			if ok, _ := utils.IsHiddenFile(path); ok {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if !d.IsDir() {
+			if found != nil && d.Type().IsRegular() {
+				found(path)
+			}
+			return nil
+		}
+
+		if err := w.w.Add(path); err != nil {
+			if path == root {
+				return err
+			}
+			logger.Error().Err(err).Str("path", path).Msg("watch directory")
+			return nil
+		}
+		w.dirsMu.Lock()
+		if w.dirs == nil {
+			w.dirs = make(map[string]bool)
+		}
+		w.dirs[path] = true
+		w.dirsMu.Unlock()
+		return nil
+	})
+}
+
+// removeRecursive drops the watches on root and all directories below it, returning
+// how many were removed. Only a watched root has directories below it to look for.
+func (w *FSWatcher) removeRecursive(root string) int {
+	w.dirsMu.Lock()
+	defer w.dirsMu.Unlock()
+	if !w.dirs[root] {
+		return 0
+	}
+
+	var n int
+	prefix := root + string(filepath.Separator)
+	for path := range w.dirs {
+		if path == root || strings.HasPrefix(path, prefix) {
+			// inotify may already have dropped a deleted directory.
+			_ = w.w.Remove(path)
+			delete(w.dirs, path)
+			n++
+		}
+	}
+	return n
+}
+
+// A resultSync is the product of reading and summing a file, sum being a utils.Digest.
 type resultSync struct {
 	path string
 	sum  string
-	err  error
+	// mediaType the type of the file when the walk learned it, empty otherwise.
+	mediaType string
+	err       error
 }
 
 func (w *FSWatcher) syncFile(path string, index int) {
+	if !exists(path) {
+		// an unmounted path must not look like every file was deleted.
+		logger.Error().Str("path", path).Msg("watch path not found, skip sync")
+		return
+	}
+
+	if dirPath := backupRoot(index); !config.DryRun {
+		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+			_ = os.MkdirAll(dirPath, 0700)
+		}
+	}
+
 	drive := make(chan resultSync)
 	driveErr := make(chan error, 1)
-	w.hardDrive(drive, driveErr)
+	w.hardDrive(index, drive, driveErr)
 
+	// sum -> backup path and backup path -> sum
 	mDrive := make(map[string]string)
+	byPath := make(map[string]string)
 	for r := range drive {
 		if r.err != nil {
 			logger.Error().Err(r.err).Msg("hard drive")
 			continue
 		}
 		mDrive[r.sum] = r.path
+		byPath[r.path] = r.sum
 	}
 
 	if err := <-driveErr; err != nil {
@@ -133,35 +413,31 @@ func (w *FSWatcher) syncFile(path string, index int) {
 			continue
 		}
 
-		if _, ok := mDrive[r.sum]; ok {
+		// up to date when the backup at the same relative path holds the same content,
+		// the path split at the length of the root which may recur below it
+		subPath := []string{path, r.path[len(path):]}
+		dst := core.BackupPath(subPath)
+		if byPath[dst] == r.sum {
 			continue
-		} else {
-			var countDuplicate int
-			for _, v := range mDrive {
-				if filepath.Base(v) == filepath.Base(r.path) {
-					countDuplicate++
-				}
-			}
+		}
 
-			if countDuplicate >= 1 {
+		// the same content sits elsewhere and its source is gone, the file was renamed
+		if v, ok := mDrive[r.sum]; ok && v != dst && isOrphan(v) && !exists(dst) {
+			if err := w.file.Move(v, subPath); err != nil {
+				logger.Error().Err(err).Msg("rename sync")
+			} else {
+				delete(byPath, v)
+				byPath[dst], mDrive[r.sum] = r.sum, dst
 				continue
 			}
 		}
 
-		reImage, err := regexp.Compile(core.Regexp())
-		if err != nil {
-			continue
+		mediaType := r.mediaType
+		if mediaType == "" {
+			mediaType = utils.DetectType(r.path)
 		}
-
-		subPath := strings.SplitAfter(r.path, path)
-		if reImage.MatchString(r.path) {
-			if err := w.image.Open(r.path, subPath); err != nil {
-				logger.Error().Err(err).Msg("image sync")
-			}
-		} else {
-			if err := w.file.Open(r.path, subPath); err != nil {
-				logger.Error().Err(err).Msg("file sync")
-			}
+		if err := w.processors.For(mediaType).Open(r.path, subPath, mediaType); err != nil {
+			logger.Error().Err(err).Str("kind", core.Kind(mediaType)).Msg("file sync")
 		}
 	}
 
@@ -169,72 +445,262 @@ func (w *FSWatcher) syncFile(path string, index int) {
 		logger.Error().Err(err).Msg("fatal local drive")
 		return
 	}
+
+	// deletions missed while the daemon was down
+	if config.FileSystemCfg.Backup.OnDelete == config.OnDeleteIgnore {
+		return
+	}
+	for v := range byPath {
+		src, ok := core.SourcePath(v)
+		if !ok || !strings.HasPrefix(src, path) || exists(src) {
+			continue
+		}
+		if err := w.file.Remove(v); err != nil && !os.IsNotExist(err) {
+			logger.Error().Err(err).Msg("remove sync")
+		}
+	}
+}
+
+// isOrphan reports whether the local file a backup was copied from no longer exists.
+func isOrphan(backupPath string) bool {
+	src, ok := core.SourcePath(backupPath)
+	return ok && !exists(src)
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
 }
 
-func (w *FSWatcher) hardDrive(c chan resultSync, errc chan error) {
-	dirPath := path.Join(config.FileSystemCfg.Backup.HardDrivePath, config.GetStaticBackupFolder())
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		_ = os.Mkdir(dirPath, 0700)
+// backupRoot returns the folder holding the backups of the watched path index.
+func backupRoot(index int) string {
+	p := &config.FileSystemCfg.Paths[index]
+	return path.Join(p.BackupFolder(), p.Namespace())
+}
+
+func (w *FSWatcher) hardDrive(index int, c chan resultSync, errc chan error) {
+	// backups recorded in the manifest are not read again
+	known := func(path string, _ fs.FileInfo) (string, string) {
+		if e, ok := manifest.ByBackup(path); ok {
+			return e.HashAlgo, e.Hash
+		}
+		return config.FileSystemCfg.Hash, ""
 	}
-	go walkDir(w.syncDone, c, errc, dirPath, 0, false)
+	go walkDir(w.syncDone, c, errc, backupRoot(index), false, known)
 }
 
 func (w *FSWatcher) localDrive(path string, index int, c chan resultSync, errc chan error) {
-	go walkDir(w.syncDone, c, errc, path, index, true)
+	// only files changed since their last backup are read again, with the algorithm
+	// of their last backup so a changed file.hash setting still compares
+	known := func(path string, info fs.FileInfo) (string, string) {
+		if e, ok := manifest.Get(path); ok {
+			if e.Unchanged(info) {
+				return e.HashAlgo, e.Hash
+			}
+			return e.HashAlgo, ""
+		}
+		return config.FileSystemCfg.Hash, ""
+	}
+	go walkDir(w.syncDone, c, errc, path, true, known)
 }
 
-func walkDir(done <-chan struct{}, c chan resultSync, errc chan error, path string, index int, runLocal bool) {
+// walkDir sums every file below root into c. known returns the algorithm to sum a file
+// with, and its sum when it is already recorded so the file is not read. Files are hashed by a fixed pool
+// of general.hash_worker workers sharing general.hash_memory of buffers.
+func walkDir(done <-chan struct{}, c chan resultSync, errc chan error, root string, runLocal bool, known func(string, fs.FileInfo) (string, string)) {
+	type file struct {
+		path      string
+		info      fs.FileInfo
+		mediaType string
+	}
+
+	files := make(chan file)
+	progress := newHashProgress(root)
+	bufSize := hashBufferSize(config.General.HashWorker, config.General.HashMemory)
+
 	var wg sync.WaitGroup
-	err := filepath.Walk(path, func(path string, info fs.FileInfo, err error) error {
-		if utils.IgnoreExtension(path) {
-			return nil
-		}
+	for i := 0; i < config.General.HashWorker; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bufSize)
+			for f := range files {
+				algo, sum := known(f.path, f.info)
+				var err error
+				if sum == "" {
+					var n int64
+					sum, n, err = utils.HashFile(f.path, algo, buf)
+					progress.add(n)
+				}
+				select {
+				case c <- resultSync{f.path, utils.Digest(algo, sum), f.mediaType, err}:
+				case <-done:
+				}
+			}
+		}()
+	}
 
+	// ignore reports whether the rules leave name out, and the type of name when it
+	// had to be known. An unchanged file keeps the type it was backed up with.
+	ignore := func(name string) (bool, string) {
+		info, err := os.Stat(name)
 		if err != nil {
-			return err
+			return true, ""
 		}
+		t := utils.NewMediaType(name, "")
+		if e, ok := manifest.Get(name); ok && e.Unchanged(info) {
+			t = utils.NewMediaType(name, e.Type)
+		}
+		return utils.IgnoreFile(name, name, info, t), t.Known()
+	}
+	if !runLocal {
+		// a backup follows the rules of the file it was copied from
+		ignore = func(name string) (bool, string) {
+			info, err := os.Stat(name)
+			if err != nil {
+				return true, ""
+			}
+			source, ok := core.SourcePath(name)
+			if !ok {
+				source = name
+			} else if fi, err := os.Stat(source); err == nil {
+				// the size and age rules see the source, the backup may be compressed
+				// or carry the time it was copied
+				info = fi
+			}
+			t := utils.NewMediaType(name, "")
+			if e, ok := manifest.ByBackup(name); ok {
+				t = utils.NewMediaType(name, e.Type)
+			}
+			return utils.IgnoreFile(name, source, info, t), t.Known()
+		}
+	}
 
-		if !info.Mode().IsRegular() {
+	err := filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		// the trash, the manifest and other bookkeeping of the backup drive are hidden,
+		// so are the .git or .cache folders of the watched paths, with all below them
+		if err == nil && path != root && hidden(path, info, runLocal) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		if !info.IsDir() {
-			if runLocal {
-				_, after, _ := strings.Cut(path, config.FileSystemCfg.Paths[index])
-				// start from .Folder/foo
-				ok, _ := utils.IsHiddenFile(after[1:])
-				if ok {
-					return nil
-				}
+		if info != nil && info.IsDir() {
+			if runLocal && path != root && utils.IgnoreDir(path) {
+				return filepath.SkipDir
 			}
+			return nil
+		}
 
-			wg.Add(1)
-			go func() {
-				data, err := os.ReadFile(path)
-				sum := md5.Sum(data)
-				select {
-				case c <- resultSync{path, hex.EncodeToString(sum[:]), err}:
-				case <-done:
-				}
-				wg.Done()
-			}()
+		ignored, mediaType := ignore(path)
+		if ignored {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
 		}
 
 		// Abort the walk if done is closed.
 		select {
+		case files <- file{path, info, mediaType}:
+			return nil
 		case <-done:
 			return errors.New("walk canceled")
-		default:
-			return nil
 		}
 	})
+	close(files)
 
-	// Walk has returned, so all calls to wg.Add are done.  Start a
-	// goroutine to close c once all the sends are done.
+	// Walk has returned, so no more files are queued. Start a
+	// goroutine to close c once the workers sent their sums.
 	go func() {
 		wg.Wait()
+		progress.stop()
 		close(c)
 	}()
 
 	errc <- err
 }
+
+// hidden reports whether the entry path of a walk is hidden, on the local side
+// the way the watcher tells it.
+func hidden(path string, info fs.FileInfo, runLocal bool) bool {
+	if runLocal {
+		ok, _ := utils.IsHiddenFile(path)
+		return ok
+	}
+	return strings.HasPrefix(info.Name(), ".")
+}
+
+// hashBufferSize splits the memory ceiling, in megabyte, between the workers.
+func hashBufferSize(workers, memory int) int {
+	const minBuffer, maxBuffer = 32 * 1024, 8 * 1024 * 1024
+
+	size := memory * int(utils.MB) / workers
+	if size < minBuffer {
+		return minBuffer
+	}
+	if size > maxBuffer {
+		return maxBuffer
+	}
+	return size
+}
+
+// progressInterval how often a long scan reports the files and bytes hashed.
+var progressInterval = 10 * time.Second
+
+// hashProgress logs the files and bytes hashed during a walk.
+type hashProgress struct {
+	root   string
+	start  time.Time
+	files  int64
+	bytes  int64
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+func newHashProgress(root string) *hashProgress {
+	p := &hashProgress{
+		root:   root,
+		start:  time.Now(),
+		ticker: time.NewTicker(progressInterval),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case <-p.ticker.C:
+				p.log("hashing")
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *hashProgress) add(n int64) {
+	atomic.AddInt64(&p.files, 1)
+	atomic.AddInt64(&p.bytes, n)
+}
+
+func (p *hashProgress) stop() {
+	p.ticker.Stop()
+	close(p.done)
+	if atomic.LoadInt64(&p.files) > 0 {
+		p.log("hashing complete")
+	}
+}
+
+func (p *hashProgress) log(msg string) {
+	logger.Info(time.Since(p.start)).
+		Str("path", p.root).
+		Int64("files", atomic.LoadInt64(&p.files)).
+		Str("bytes", utils.ByteSize(atomic.LoadInt64(&p.bytes)).String()).
+		Msg(msg)
+}
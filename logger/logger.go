@@ -48,6 +48,9 @@ func New() zerolog.Logger {
 	mw := zerolog.MultiLevelWriter(consoleWriterLeveled, fileWriterInfo, fileWriterError)
 	if config.Debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else if config.DryRun {
+		// the intended actions are logged at info
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	} else {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel | zerolog.ErrorLevel)
 	}
@@ -0,0 +1,464 @@
+// Package manifest keeps an on-disk index of every file copied into the backup drive,
+// so the janitor only has to hash the files that changed since their last backup.
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/hinha/watchgo/utils"
+)
+
+var (
+	// filesBucket source path -> Entry.
+	filesBucket = []byte("files")
+	// backupsBucket backup path -> source path, derivatives included.
+	backupsBucket = []byte("backups")
+	// stateBucket name -> value, progress of the long running commands.
+	stateBucket = []byte("state")
+
+	db *bolt.DB
+	// readOnly drops every update, set by OpenReadOnly.
+	readOnly bool
+	// copied the copy OpenReadOnly opened in place of a locked manifest, removed by Close.
+	copied string
+)
+
+// ErrLocked is returned by Open when another process, the daemon, holds the manifest.
+var ErrLocked = errors.New("manifest is locked by another process")
+
+// copyAttempts how many copies of a locked manifest are made until one is consistent.
+const copyAttempts = 3
+
+// Entry is the record of one backed up file.
+type Entry struct {
+	Source   string    `json:"source"`
+	Backup   string    `json:"backup"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Hash     string    `json:"hash"`
+	HashAlgo string    `json:"hash_algo"`
+	// BackupHash the hash of the copy itself, it differs from Hash when the copy was compressed.
+	BackupHash string `json:"backup_hash"`
+	// Derivative the compressed copy kept apart from an untouched backup, DerivativeHash its hash.
+	Derivative     string `json:"derivative,omitempty"`
+	DerivativeHash string `json:"derivative_hash,omitempty"`
+	// Meta what the processor of the file extracted from it, the page count, title and
+	// author of a PDF.
+	Meta map[string]string `json:"meta,omitempty"`
+	// Type the media type of the source when it was backed up, reused while the
+	// source is unchanged instead of reading its content again.
+	Type       string    `json:"type,omitempty"`
+	BackupTime time.Time `json:"backup_time"`
+	// Verified whether the copy was read back and matched Hash when it was written.
+	Verified   bool      `json:"verified"`
+	VerifiedAt time.Time `json:"verified_at"`
+	// ScrubbedAt when watchgo verify last hashed the copy, ScrubOK whether it matched.
+	ScrubbedAt time.Time `json:"scrubbed_at"`
+	ScrubOK    bool      `json:"scrub_ok"`
+}
+
+// BackupDigest returns the hash of the copy tagged with its algorithm, entries written
+// before it was recorded fall back to the hash of the source.
+func (e *Entry) BackupDigest() string {
+	if e.BackupHash == "" {
+		return e.Digest()
+	}
+	return utils.Digest(e.HashAlgo, e.BackupHash)
+}
+
+// Digest returns the hash of the entry tagged with its algorithm, entries written
+// before the algorithm was recorded are md5.
+func (e *Entry) Digest() string {
+	return utils.Digest(e.HashAlgo, e.Hash)
+}
+
+// Unchanged reports whether the local file described by fi still matches the entry,
+// meaning its stored hash can be used without reading the file.
+func (e *Entry) Unchanged(fi os.FileInfo) bool {
+	return e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime())
+}
+
+// Open opens or creates the manifest at file. Until it is called every lookup misses
+// and every update is dropped.
+func Open(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return err
+	}
+
+	b, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return fmt.Errorf("%s: %w", file, ErrLocked)
+		}
+		return err
+	}
+
+	err = b.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{filesBucket, backupsBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = b.Close()
+		return err
+	}
+
+	db = b
+	return nil
+}
+
+// OpenReadOnly opens the manifest at file for lookups only, every update being dropped.
+// A missing manifest is left uncreated, every lookup then misses. When the daemon
+// holds the manifest a copy of it is opened instead, as it was when copied.
+func OpenReadOnly(file string) error {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+
+	b, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return openCopy(file)
+	}
+	if err != nil {
+		return err
+	}
+	db, readOnly = b, true
+	return nil
+}
+
+// openCopy opens a copy of the locked manifest file. The daemon may commit while it
+// is copied, a copy is only kept once its pages check.
+func openCopy(file string) error {
+	var err error
+	for attempt := 0; attempt < copyAttempts; attempt++ {
+		var name string
+		if name, err = copyFile(file); err != nil {
+			return err
+		}
+
+		var b *bolt.DB
+		b, err = bolt.Open(name, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+		if err == nil {
+			err = b.View(func(tx *bolt.Tx) error {
+				for err := range tx.Check() {
+					return err
+				}
+				return nil
+			})
+			if err == nil {
+				db, readOnly, copied = b, true, name
+				return nil
+			}
+			_ = b.Close()
+		}
+		_ = os.Remove(name)
+	}
+	return fmt.Errorf("%s: %w, no consistent copy: %v", file, ErrLocked, err)
+}
+
+// copyFile copies file into a temporary file and returns its name.
+func copyFile(file string) (string, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp("", filepath.Base(file)+".*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), dst.Close()
+}
+
+// Opened reports whether a manifest is open, the lookups miss otherwise.
+func Opened() bool {
+	return db != nil
+}
+
+// Copied reports whether the opened manifest is a copy of one the daemon holds.
+func Copied() bool {
+	return copied != ""
+}
+
+// Close flushes and closes the manifest.
+func Close() error {
+	if db == nil {
+		return nil
+	}
+	err := db.Close()
+	if copied != "" {
+		_ = os.Remove(copied)
+	}
+	db, readOnly, copied = nil, false, ""
+	return err
+}
+
+// Get returns the entry of the local file source.
+func Get(source string) (*Entry, bool) {
+	if db == nil {
+		return nil, false
+	}
+
+	var e *Entry
+	_ = db.View(func(tx *bolt.Tx) error {
+		e = decode(tx.Bucket(filesBucket).Get([]byte(source)))
+		return nil
+	})
+	return e, e != nil
+}
+
+// ByBackup returns the entry whose copy is stored at backup.
+func ByBackup(backup string) (*Entry, bool) {
+	if db == nil {
+		return nil, false
+	}
+
+	var e *Entry
+	_ = db.View(func(tx *bolt.Tx) error {
+		source := tx.Bucket(backupsBucket).Get([]byte(backup))
+		if source != nil {
+			e = decode(tx.Bucket(filesBucket).Get(source))
+		}
+		return nil
+	})
+	return e, e != nil
+}
+
+// List returns up to n entries ordered by their backup, starting after the backup after.
+func List(after string, n int) []Entry {
+	if db == nil {
+		return nil
+	}
+
+	var entries []Entry
+	_ = db.View(func(tx *bolt.Tx) error {
+		files := tx.Bucket(filesBucket)
+		c := tx.Bucket(backupsBucket).Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(entries) < n; k, v = c.Next() {
+			// derivatives are listed along with their backup
+			if e := decode(files.Get(v)); e != nil && e.Backup == string(k) {
+				entries = append(entries, *e)
+			}
+		}
+		return nil
+	})
+	return entries
+}
+
+// State returns the value saved under name, empty when there is none.
+func State(name string) string {
+	if db == nil {
+		return ""
+	}
+
+	var value string
+	_ = db.View(func(tx *bolt.Tx) error {
+		value = string(tx.Bucket(stateBucket).Get([]byte(name)))
+		return nil
+	})
+	return value
+}
+
+// SetState saves value under name, an empty value deletes it.
+func SetState(name, value string) error {
+	if db == nil || readOnly {
+		return nil
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if value == "" {
+			return tx.Bucket(stateBucket).Delete([]byte(name))
+		}
+		return tx.Bucket(stateBucket).Put([]byte(name), []byte(value))
+	})
+}
+
+// Put stores e, replacing the previous entry of the same source.
+func Put(e Entry) error {
+	if db == nil || readOnly {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		files, backups := tx.Bucket(filesBucket), tx.Bucket(backupsBucket)
+		if prev := decode(files.Get([]byte(e.Source))); prev != nil {
+			for _, name := range []string{prev.Backup, prev.Derivative} {
+				if name == "" || name == e.Backup || name == e.Derivative {
+					continue
+				}
+				if err := backups.Delete([]byte(name)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := files.Put([]byte(e.Source), data); err != nil {
+			return err
+		}
+		if e.Derivative != "" {
+			if err := backups.Put([]byte(e.Derivative), []byte(e.Source)); err != nil {
+				return err
+			}
+		}
+		return backups.Put([]byte(e.Backup), []byte(e.Source))
+	})
+}
+
+// SetScrubbed records the ScrubbedAt and ScrubOK of the entries and saves value under
+// the state name, in one transaction. An entry whose backup changed since it was
+// listed is left as is.
+func SetScrubbed(entries []Entry, name, value string) error {
+	if db == nil || readOnly {
+		return nil
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket(filesBucket)
+		for _, e := range entries {
+			cur := decode(files.Get([]byte(e.Source)))
+			if cur == nil || cur.Backup != e.Backup || cur.BackupHash != e.BackupHash || cur.Hash != e.Hash {
+				continue
+			}
+			cur.ScrubbedAt, cur.ScrubOK = e.ScrubbedAt, e.ScrubOK
+			data, err := json.Marshal(cur)
+			if err != nil {
+				return err
+			}
+			if err := files.Put([]byte(e.Source), data); err != nil {
+				return err
+			}
+		}
+
+		if value == "" {
+			return tx.Bucket(stateBucket).Delete([]byte(name))
+		}
+		return tx.Bucket(stateBucket).Put([]byte(name), []byte(value))
+	})
+}
+
+// Move rewrites the entries stored under oldBackup, a file or a directory, after it
+// was renamed to newBackup because its source moved from oldSource to newSource.
+func Move(oldBackup, newBackup, oldSource, newSource string) error {
+	if db == nil || readOnly {
+		return nil
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		files, backups := tx.Bucket(filesBucket), tx.Bucket(backupsBucket)
+		for _, e := range under(tx, oldBackup) {
+			if err := files.Delete([]byte(e.Source)); err != nil {
+				return err
+			}
+			if err := backups.Delete([]byte(e.Backup)); err != nil {
+				return err
+			}
+
+			e.Backup = newBackup + strings.TrimPrefix(e.Backup, oldBackup)
+			e.Source = newSource + strings.TrimPrefix(e.Source, oldSource)
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := files.Put([]byte(e.Source), data); err != nil {
+				return err
+			}
+			if err := backups.Put([]byte(e.Backup), []byte(e.Source)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Under returns the entries whose backup is backup itself or lies below it.
+func Under(backup string) []Entry {
+	if db == nil {
+		return nil
+	}
+
+	var entries []Entry
+	_ = db.View(func(tx *bolt.Tx) error {
+		entries = under(tx, backup)
+		return nil
+	})
+	return entries
+}
+
+// Delete drops the entries stored under backup, a file or a directory.
+func Delete(backup string) error {
+	if db == nil || readOnly {
+		return nil
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, e := range under(tx, backup) {
+			if err := tx.Bucket(filesBucket).Delete([]byte(e.Source)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(backupsBucket).Delete([]byte(e.Backup)); err != nil {
+				return err
+			}
+			if e.Derivative == "" {
+				continue
+			}
+			if err := tx.Bucket(backupsBucket).Delete([]byte(e.Derivative)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// under returns the entries whose backup is backup itself or lies below it.
+func under(tx *bolt.Tx, backup string) []Entry {
+	var entries []Entry
+	files := tx.Bucket(filesBucket)
+	c := tx.Bucket(backupsBucket).Cursor()
+	for k, v := c.Seek([]byte(backup)); k != nil && strings.HasPrefix(string(k), backup); k, v = c.Next() {
+		if len(k) != len(backup) && k[len(backup)] != filepath.Separator {
+			continue
+		}
+		if e := decode(files.Get(v)); e != nil && e.Backup == string(k) {
+			entries = append(entries, *e)
+		}
+	}
+	return entries
+}
+
+func decode(data []byte) *Entry {
+	if data == nil {
+		return nil
+	}
+
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil
+	}
+	return &e
+}
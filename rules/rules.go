@@ -0,0 +1,348 @@
+// Package rules matches the files of a watched path against ordered include and
+// exclude rules written like the lines of a .gitignore, with size and age predicates.
+//
+// A rule is a glob pattern, the spaces in it included, followed by size and age
+// predicates, or predicates alone:
+//
+//	**/*.tmp            exclude the .tmp files at any depth
+//	!important/**       include everything below important
+//	build/              exclude the build directories
+//	My Documents/       exclude the My Documents directories
+//	size>1GB            exclude the files larger than 1GB
+//	*.log age>720h      exclude the logs not modified for 30 days
+//
+// The last rule matching a file decides, a file in an excluded directory can not be
+// included again.
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FileName the per directory rules file, applying to the files below its directory.
+const FileName = ".watchgoignore"
+
+// Rule is one parsed rule.
+type Rule struct {
+	// Negate includes the files matched instead of excluding them.
+	Negate bool
+	// base the directory the rule was read in, relative to the watched path.
+	base    string
+	re      *regexp.Regexp
+	dirOnly bool
+	preds   []predicate
+}
+
+// predicate compares the size or the age of a file with a value.
+type predicate struct {
+	size  bool
+	op    string
+	value int64
+}
+
+// Set is the ordered rules of a watched path.
+type Set []Rule
+
+var rePredicate = regexp.MustCompile(`^(size|age)(<=|>=|<|>)(.+)$`)
+
+// Parse returns the rule of line, read in the directory base relative to the watched
+// path. ok is false for blank lines and comments. As in a .gitignore the spaces of
+// the pattern are part of it, only the trailing ones are dropped unless escaped, and
+// the size and age predicates are the last words of the line.
+func Parse(line, base string) (r Rule, ok bool, err error) {
+	line = trimTrailing(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		r.Negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	r.base = strings.Trim(path.Clean("/"+base), "/")
+
+	pattern := line
+	for {
+		i := strings.LastIndexAny(pattern, " \t")
+		if i > 0 && pattern[i-1] == '\\' {
+			break
+		}
+		m := rePredicate.FindStringSubmatch(pattern[i+1:])
+		if m == nil {
+			break
+		}
+		p, err := parsePredicate(m[1], m[2], m[3])
+		if err != nil {
+			return r, false, fmt.Errorf("rule %q: %w", line, err)
+		}
+		r.preds = append(r.preds, p)
+		if i < 0 {
+			pattern = ""
+			break
+		}
+		pattern = trimTrailing(pattern[:i])
+	}
+	if pattern == "" && len(r.preds) == 0 {
+		return r, false, fmt.Errorf("rule %q is empty", line)
+	}
+	if pattern != "" {
+		if r.re, r.dirOnly, err = compile(pattern); err != nil {
+			return r, false, fmt.Errorf("rule %q: %w", line, err)
+		}
+	}
+	return r, true, nil
+}
+
+// ParseAll returns the rules of lines, read in the directory base. A line that does
+// not parse is left out, the first error is returned along with the other rules.
+func ParseAll(lines []string, base string) (Set, error) {
+	var s Set
+	var first error
+	for _, line := range lines {
+		r, ok, err := Parse(line, base)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		if ok {
+			s = append(s, r)
+		}
+	}
+	return s, first
+}
+
+// Load returns the rules of the file name, read in the directory base. Like ParseAll
+// the rules that parse are returned with the error of the others.
+func Load(name, base string) (Set, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	s, err := ParseAll(lines, base)
+	if err != nil {
+		return s, fmt.Errorf("%s: %w", name, err)
+	}
+	return s, nil
+}
+
+// Match applies s to the file rel, relative to the watched path with slashes, and
+// info its FileInfo. excluded is the decision of the last rule matching the file or
+// one of its directories, matched reports whether a rule matched at all.
+func (s Set) Match(rel string, info os.FileInfo, now time.Time) (excluded, matched bool) {
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		// a file in an excluded directory can not be included again
+		if x, ok := s.match(dir, nil, now); ok && x {
+			return true, true
+		}
+	}
+	return s.match(rel, info, now)
+}
+
+// MatchDir reports whether the directory rel, or one above it, is excluded.
+func (s Set) MatchDir(rel string) bool {
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+	for dir := rel; dir != "."; dir = path.Dir(dir) {
+		if x, ok := s.match(dir, nil, time.Time{}); ok && x {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the decision of the last rule matching rel, a directory when info is nil.
+func (s Set) match(rel string, info os.FileInfo, now time.Time) (excluded, matched bool) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i].matches(rel, info, now) {
+			return !s[i].Negate, true
+		}
+	}
+	return false, false
+}
+
+func (r Rule) matches(rel string, info os.FileInfo, now time.Time) bool {
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	isDir := info == nil || info.IsDir()
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.re != nil && !r.re.MatchString(rel) {
+		return false
+	}
+	if len(r.preds) > 0 && isDir {
+		return false
+	}
+	for _, p := range r.preds {
+		if !p.matches(info, now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p predicate) matches(info os.FileInfo, now time.Time) bool {
+	v := info.Size()
+	if !p.size {
+		v = int64(now.Sub(info.ModTime()))
+	}
+	switch p.op {
+	case "<":
+		return v < p.value
+	case "<=":
+		return v <= p.value
+	case ">":
+		return v > p.value
+	}
+	return v >= p.value
+}
+
+// sizeUnits the multiplier of the size suffixes, in lower case.
+var sizeUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+}
+
+// parsePredicate parses a size like 10MB or an age, a duration like 72h or a number
+// of days like 30d.
+func parsePredicate(kind, op, value string) (predicate, error) {
+	p := predicate{size: kind == "size", op: op}
+	if p.size {
+		i := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i < 0 {
+			i = len(value)
+		}
+		unit, ok := sizeUnits[strings.ToLower(value[i:])]
+		n, err := strconv.ParseFloat(value[:i], 64)
+		if !ok || err != nil {
+			return p, fmt.Errorf("invalid size %q", value)
+		}
+		p.value = int64(n * float64(unit))
+		return p, nil
+	}
+
+	if strings.HasSuffix(value, "d") {
+		n, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid age %q", value)
+		}
+		p.value = int64(n * float64(24*time.Hour))
+		return p, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return p, fmt.Errorf("invalid age %q", value)
+	}
+	p.value = int64(d)
+	return p, nil
+}
+
+// trimTrailing drops the spaces ending line, but one escaped by a backslash.
+func trimTrailing(line string) string {
+	for n := len(line); n > 0 && (line[n-1] == ' ' || line[n-1] == '\t'); n-- {
+		if n > 1 && line[n-2] == '\\' {
+			return line[:n]
+		}
+		line = line[:n-1]
+	}
+	return line
+}
+
+// compile turns the glob pattern into an expression matching the relative paths.
+// A pattern without a slash but a trailing one matches at any depth, a trailing
+// slash matches directories only.
+func compile(pattern string) (*regexp.Regexp, bool, error) {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return nil, false, fmt.Errorf("empty pattern")
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				switch {
+				case strings.HasPrefix(pattern[i:], "**/"):
+					b.WriteString("(?:.*/)?")
+					i += 2
+				default:
+					b.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j < 0 {
+				return nil, false, fmt.Errorf("unterminated [")
+			}
+			class := pattern[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += j + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				_, n := utf8.DecodeRuneInString(pattern[i+1:])
+				b.WriteString(regexp.QuoteMeta(pattern[i+1 : i+1+n]))
+				i += n
+			}
+		default:
+			// the literal run up to the next special byte, multibyte runes whole
+			j := strings.IndexAny(pattern[i:], `*?[\`)
+			if j < 0 {
+				j = len(pattern) - i
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+j]))
+			i += j - 1
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	return re, dirOnly, err
+}
@@ -0,0 +1,237 @@
+package rules
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fileInfo is the FileInfo of a file of size bytes modified at mod.
+type fileInfo struct {
+	size int64
+	mod  time.Time
+	dir  bool
+}
+
+func (f fileInfo) Name() string       { return "" }
+func (f fileInfo) Size() int64        { return f.size }
+func (f fileInfo) Mode() fs.FileMode  { return 0 }
+func (f fileInfo) ModTime() time.Time { return f.mod }
+func (f fileInfo) IsDir() bool        { return f.dir }
+func (f fileInfo) Sys() interface{}   { return nil }
+
+var now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func small() fileInfo { return fileInfo{size: 10, mod: now} }
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		rel      string
+		info     os.FileInfo
+		excluded bool
+		matched  bool
+	}{
+		{"any depth", []string{"**/*.tmp"}, "x.tmp", small(), true, true},
+		{"any depth nested", []string{"**/*.tmp"}, "a/b/x.tmp", small(), true, true},
+		{"any depth other ext", []string{"**/*.tmp"}, "a/x.tmpl", small(), false, false},
+		{"no slash any depth", []string{"*.log"}, "a/b/x.log", small(), true, true},
+		{"include again", []string{"**/*.tmp", "!important/**"}, "important/x.tmp", small(), false, true},
+		{"include again elsewhere", []string{"**/*.tmp", "!important/**"}, "other/x.tmp", small(), true, true},
+		{"last rule decides", []string{"!important/**", "**/*.tmp"}, "important/x.tmp", small(), true, true},
+		{"dir only matches dir", []string{"build/"}, "build/out.o", small(), true, true},
+		{"dir only nested", []string{"build/"}, "src/build/out.o", small(), true, true},
+		{"dir only skips file", []string{"build/"}, "build", small(), false, false},
+		{"plain name matches file", []string{"build"}, "build", small(), true, true},
+		{"plain name matches dir", []string{"build"}, "build/out.o", small(), true, true},
+		{"anchored", []string{"/foo"}, "foo", small(), true, true},
+		{"anchored not nested", []string{"/foo"}, "a/foo", small(), false, false},
+		{"middle slash anchored", []string{"a/foo"}, "b/a/foo", small(), false, false},
+		{"double star middle", []string{"a/**/z.txt"}, "a/b/c/z.txt", small(), true, true},
+		{"double star middle none", []string{"a/**/z.txt"}, "a/z.txt", small(), true, true},
+		{"question mark", []string{"?.txt"}, "a.txt", small(), true, true},
+		{"question mark no slash", []string{"a?b"}, "a/b", small(), false, false},
+		{"class negated", []string{"[!x].txt"}, "a.txt", small(), true, true},
+		{"class negated miss", []string{"[!x].txt"}, "x.txt", small(), false, false},
+		{"class", []string{"[ab].txt"}, "b.txt", small(), true, true},
+		{"utf-8 name", []string{"résumé.pdf"}, "docs/résumé.pdf", small(), true, true},
+		{"utf-8 name other", []string{"résumé.pdf"}, "docs/resume.pdf", small(), false, false},
+		{"utf-8 dir", []string{"café/"}, "café/menu.txt", small(), true, true},
+		{"utf-8 double star", []string{"文档/**"}, "文档/a/b.txt", small(), true, true},
+		{"utf-8 question mark", []string{"?.txt"}, "é.txt", small(), true, true},
+		{"utf-8 class", []string{"[éè].txt"}, "è.txt", small(), true, true},
+		{"utf-8 escaped", []string{`\é*`}, "été.txt", small(), true, true},
+		{"escaped space", []string{`a\ b.txt`}, "a b.txt", small(), true, true},
+		{"literal space", []string{"My Documents/"}, "My Documents/a.txt", small(), true, true},
+		{"trailing space dropped", []string{"a.txt  "}, "a.txt", small(), true, true},
+		{"escaped trailing space", []string{`a\ `}, "a ", small(), true, true},
+		{"escaped bang", []string{`\!a`}, "!a", small(), true, true},
+		{"size above", []string{"size>1.5GB"}, "big.iso", fileInfo{size: 2 << 30, mod: now}, true, true},
+		{"size below", []string{"size>1.5GB"}, "small.iso", fileInfo{size: 1 << 30, mod: now}, false, false},
+		{"size bytes", []string{"size<=10"}, "a", small(), true, true},
+		{"size kb", []string{"size<1KB"}, "a", fileInfo{size: 1024, mod: now}, false, false},
+		{"age days", []string{"age>30d"}, "old", fileInfo{size: 1, mod: now.Add(-31 * 24 * time.Hour)}, true, true},
+		{"age days recent", []string{"age>30d"}, "new", fileInfo{size: 1, mod: now.Add(-29 * 24 * time.Hour)}, false, false},
+		{"age duration", []string{"age<2h"}, "new", fileInfo{size: 1, mod: now.Add(-time.Hour)}, true, true},
+		{"pattern and predicate", []string{"*.log age>720h"}, "old.log", fileInfo{size: 1, mod: now.Add(-800 * time.Hour)}, true, true},
+		{"pattern and predicate other", []string{"*.log age>720h"}, "old.txt", fileInfo{size: 1, mod: now.Add(-800 * time.Hour)}, false, false},
+		{"spaces and predicate", []string{"My Logs/** size>1KB"}, "My Logs/a", fileInfo{size: 2048, mod: now}, true, true},
+		{"predicates skip dirs", []string{"size<1KB"}, "dir/a", fileInfo{size: 2048, mod: now}, false, false},
+		{"excluded dir not included again", []string{"logs/", "!logs/keep.txt"}, "logs/keep.txt", small(), true, true},
+		{"excluded dir nested not included again", []string{"cache", "!**/*.txt"}, "a/cache/b/keep.txt", small(), true, true},
+		{"files excluded can be included again", []string{"logs/*", "!logs/keep.txt"}, "logs/keep.txt", small(), false, true},
+		{"comment", []string{"# *.txt"}, "a.txt", small(), false, false},
+		{"no rules", nil, "a.txt", small(), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseAll(tt.rules, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			excluded, matched := s.Match(tt.rel, tt.info, now)
+			if excluded != tt.excluded || matched != tt.matched {
+				t.Errorf("Match(%q) with %q = %v, %v, want %v, %v", tt.rel, tt.rules, excluded, matched, tt.excluded, tt.matched)
+			}
+		})
+	}
+}
+
+func TestMatchBase(t *testing.T) {
+	s, err := ParseAll([]string{"*.tmp"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rules of docs/.watchgoignore only apply below docs
+	docs, err := ParseAll([]string{"*.bak", "!keep.tmp", "/top.txt"}, "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = append(s, docs...)
+
+	tests := []struct {
+		rel      string
+		excluded bool
+	}{
+		{"x.bak", false},
+		{"docs/x.bak", true},
+		{"docs/a/x.bak", true},
+		{"docs/keep.tmp", false},
+		{"docs/a/keep.tmp", false},
+		{"keep.tmp", true},
+		{"docs/top.txt", true},
+		{"docs/a/top.txt", false},
+		{"top.txt", false},
+		{"docsx/x.bak", false},
+	}
+	for _, tt := range tests {
+		if excluded, _ := s.Match(tt.rel, small(), now); excluded != tt.excluded {
+			t.Errorf("Match(%q) = %v, want %v", tt.rel, excluded, tt.excluded)
+		}
+	}
+}
+
+func TestMatchDir(t *testing.T) {
+	s, err := ParseAll([]string{"build/", "*.tmp", "!keep/", "size>1GB"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rel      string
+		excluded bool
+	}{
+		{"build", true},
+		{"src/build", true},
+		{"build/sub", true},
+		{"src", false},
+		{"a.tmp", true},
+		{"keep", false},
+	}
+	for _, tt := range tests {
+		if got := s.MatchDir(tt.rel); got != tt.excluded {
+			t.Errorf("MatchDir(%q) = %v, want %v", tt.rel, got, tt.excluded)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, line := range []string{
+		"!",
+		"size>1XB",
+		"age>soon",
+		"[abc",
+	} {
+		if _, _, err := Parse(line, ""); err == nil {
+			t.Errorf("Parse(%q) accepted", line)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment"} {
+		if _, ok, err := Parse(line, ""); ok || err != nil {
+			t.Errorf("Parse(%q) = %v, %v, want a skipped line", line, ok, err)
+		}
+	}
+}
+
+func TestParseAllKeepsValid(t *testing.T) {
+	s, err := ParseAll([]string{"*.tmp", "size>1XB", "build/"}, "")
+	if err == nil {
+		t.Fatal("invalid line accepted")
+	}
+	if len(s) != 2 {
+		t.Fatalf("got %d rules, want the 2 valid ones", len(s))
+	}
+}
+
+func TestLoad(t *testing.T) {
+	name := filepath.Join(t.TempDir(), FileName)
+	content := "# temporary files\n*.tmp\n\nsize>zz\n!keep.tmp\n"
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Load(name, "sub")
+	if err == nil {
+		t.Fatal("invalid line accepted")
+	}
+	if len(s) != 2 {
+		t.Fatalf("got %d rules, want 2", len(s))
+	}
+	if excluded, _ := s.Match("sub/a.tmp", small(), now); !excluded {
+		t.Error("sub/a.tmp not excluded")
+	}
+	if excluded, _ := s.Match("sub/keep.tmp", small(), now); excluded {
+		t.Error("sub/keep.tmp excluded")
+	}
+	if excluded, _ := s.Match("a.tmp", small(), now); excluded {
+		t.Error("a.tmp outside sub excluded")
+	}
+}
+
+func TestParsePredicate(t *testing.T) {
+	tests := []struct {
+		kind, value string
+		want        int64
+	}{
+		{"size", "10", 10},
+		{"size", "1k", 1 << 10},
+		{"size", "1.5GB", 3 << 29},
+		{"size", "2tb", 2 << 40},
+		{"age", "30d", int64(30 * 24 * time.Hour)},
+		{"age", "1.5d", int64(36 * time.Hour)},
+		{"age", "90m", int64(90 * time.Minute)},
+	}
+	for _, tt := range tests {
+		p, err := parsePredicate(tt.kind, ">", tt.value)
+		if err != nil {
+			t.Errorf("parsePredicate(%s%s): %v", tt.kind, tt.value, err)
+			continue
+		}
+		if p.value != tt.want {
+			t.Errorf("parsePredicate(%s%s) = %d, want %d", tt.kind, tt.value, p.value, tt.want)
+		}
+	}
+}
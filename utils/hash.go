@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+
+	"github.com/hinha/watchgo/config"
+)
+
+// NewHash returns the hasher of algo, one of the file_system.hash values.
+func NewHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case config.HashMD5, "":
+		return md5.New(), nil
+	case config.HashSHA256:
+		return sha256.New(), nil
+	case config.HashBLAKE3:
+		return blake3.New(), nil
+	case config.HashXXH3:
+		return xxh3.New(), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algo)
+}
+
+// HashFile streams the file at name through the algo hasher using buf, so large files
+// are never held in memory. It returns the hex digest and the number of bytes read.
+func HashFile(name, algo string, buf []byte) (string, int64, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", 0, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	n, err := io.CopyBuffer(h, f, buf)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// Digest joins algo and the hex sum, so sums of different algorithms never compare equal.
+func Digest(algo, sum string) string {
+	if algo == "" {
+		algo = config.HashMD5
+	}
+	return algo + ":" + sum
+}
+
+// SplitDigest is the inverse of Digest.
+func SplitDigest(digest string) (algo, sum string) {
+	algo, sum, ok := strings.Cut(digest, ":")
+	if !ok {
+		return config.HashMD5, digest
+	}
+	return algo, sum
+}
@@ -2,6 +2,8 @@
 
 package utils
 
+import "path/filepath"
+
 func IsHiddenFile(filename string) (bool, error) {
-	return filename[0:1] == ".", nil
+	return filepath.Base(filename)[0:1] == ".", nil
 }
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/logger"
+	"github.com/hinha/watchgo/rules"
+)
+
+// pathRule the parsed ignore rules of a watched path, parsed again when a reload
+// of the config changed their lines.
+type pathRule struct {
+	lines string
+	set   rules.Set
+}
+
+// ignoreFile a loaded .watchgoignore, read again once changed.
+type ignoreFile struct {
+	modTime time.Time
+	size    int64
+	set     rules.Set
+}
+
+var (
+	rulesMu sync.Mutex
+	// pathRules watched path -> its parsed ignore rules.
+	pathRules = make(map[string]pathRule)
+	// ignoreFiles .watchgoignore path -> its rules.
+	ignoreFiles = make(map[string]ignoreFile)
+)
+
+// ruleSet returns the rules deciding for the file rel of the watched path p: the
+// configured ones followed by the .watchgoignore of each directory down to the file.
+func ruleSet(p *config.PathConfig, rel string) rules.Set {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+
+	ignore := p.GetIgnore()
+	lines := strings.Join(ignore, "\n")
+	cached, ok := pathRules[p.Path]
+	if !ok || cached.lines != lines {
+		// validated when the config was loaded
+		set, _ := rules.ParseAll(ignore, "")
+		cached = pathRule{lines, set}
+		pathRules[p.Path] = cached
+	}
+	set := cached.set[:len(cached.set):len(cached.set)]
+
+	var dirs []string
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, "")
+	for i := len(dirs) - 1; i >= 0; i-- {
+		set = append(set, loadIgnore(filepath.Join(p.Path, filepath.FromSlash(dirs[i]), rules.FileName), dirs[i])...)
+	}
+	return set
+}
+
+// loadIgnore returns the rules of the .watchgoignore name in the directory base,
+// none when it does not exist. The lines that do not parse are logged and skipped,
+// the others still apply.
+func loadIgnore(name, base string) rules.Set {
+	fi, err := os.Stat(name)
+	if err != nil {
+		delete(ignoreFiles, name)
+		return nil
+	}
+	if f, ok := ignoreFiles[name]; ok && f.modTime.Equal(fi.ModTime()) && f.size == fi.Size() {
+		return f.set
+	}
+
+	set, err := rules.Load(name, base)
+	if err != nil {
+		logger.Error().Err(err).Str("path", name).Msg("ignore rules, invalid lines skipped")
+	}
+	ignoreFiles[name] = ignoreFile{fi.ModTime(), fi.Size(), set}
+	return set
+}
+
+// relative returns name relative to the watched path p, with slashes.
+func relative(p *config.PathConfig, name string) string {
+	return filepath.ToSlash(strings.TrimPrefix(name[len(p.Path):], string(filepath.Separator)))
+}
+
+// IgnoreDir reports whether the rules exclude the directory fullPath, and with it
+// every file below.
+func IgnoreDir(fullPath string) bool {
+	p, ok := config.FileSystemCfg.Find(fullPath)
+	if !ok || fullPath == p.Path {
+		return false
+	}
+	rel := relative(p, fullPath)
+	return ruleSet(p, rel).MatchDir(rel)
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/rules"
+)
+
+func TestHasPrefix(t *testing.T) {
+	tests := []struct {
+		base   string
+		prefix []string
+		want   bool
+	}{
+		{"report.pdf", nil, true},
+		{"report.pdf", []string{"*"}, true},
+		{"report.pdf", []string{"rep"}, true},
+		{"Report.pdf", []string{"rep"}, true},
+		{"report.pdf", []string{"REP"}, true},
+		{"report.pdf", []string{"img", "rep"}, true},
+		{"photo.jpg", []string{"img", "rep"}, false},
+		{".gitignore", []string{".gitignore"}, true},
+	}
+	for _, tt := range tests {
+		if got := hasPrefix(tt.base, tt.prefix); got != tt.want {
+			t.Errorf("hasPrefix(%q, %q) = %v, want %v", tt.base, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// loadConfig loads a config watching root with the global ignore rules.
+func loadConfig(t *testing.T, root string, ignore string) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "config.yml")
+	content := "file_system:\n" +
+		"  paths:\n    - " + root + "\n" +
+		"  backup:\n" +
+		"    hard_drive_path: " + t.TempDir() + "\n" +
+		"    ignore: " + ignore + "\n"
+	write(t, name, content)
+	if err := config.LoadConfig(name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func write(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "docs")
+	loadConfig(t, root, `["**/*.tmp", "build/"]`)
+
+	write(t, filepath.Join(root, "a.txt"), "a\n")
+	write(t, filepath.Join(root, "a.tmp"), "a\n")
+	write(t, filepath.Join(root, "build", "b.txt"), "b\n")
+	write(t, filepath.Join(root, "sub", "keep.tmp"), "k\n")
+	write(t, filepath.Join(root, "sub", "x.bak"), "x\n")
+	write(t, filepath.Join(root, "sub", "deep", "y.bak"), "y\n")
+	write(t, filepath.Join(root, "sub", "blob"), "\x00\x01\x02")
+	write(t, filepath.Join(root, "sub", rules.FileName), "*.bak\n!keep.tmp\n!blob\n")
+
+	tests := []struct {
+		rel    string
+		ignore bool
+	}{
+		{"a.txt", false},
+		{"a.tmp", true},
+		{"build/b.txt", true},
+		{"sub/keep.tmp", false},
+		{"sub/x.bak", true},
+		{"sub/deep/y.bak", true},
+		// included by a rule whatever its type
+		{"sub/blob", false},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(root, filepath.FromSlash(tt.rel))
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := IgnoreFile(name, name, fi, NewMediaType(name, "")); got != tt.ignore {
+			t.Errorf("IgnoreFile(%s) = %v, want %v", tt.rel, got, tt.ignore)
+		}
+	}
+
+	if !IgnoreDir(filepath.Join(root, "build")) {
+		t.Error("build not ignored")
+	}
+	if IgnoreDir(filepath.Join(root, "sub")) {
+		t.Error("sub ignored")
+	}
+}
+
+func TestIgnoreFileReload(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "docs")
+	name := filepath.Join(root, "a.tmp")
+	write(t, name, "a\n")
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadConfig(t, root, `["*.tmp"]`)
+	if !IgnoreFile(name, name, fi, NewMediaType(name, "")) {
+		t.Fatal("a.tmp not ignored")
+	}
+
+	// the same watched path with other rules
+	loadConfig(t, root, `["*.bak"]`)
+	if IgnoreFile(name, name, fi, NewMediaType(name, "")) {
+		t.Fatal("a.tmp still ignored after the rules changed")
+	}
+}
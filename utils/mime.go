@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen the number of leading bytes the content type is detected from.
+const sniffLen = 512
+
+// OctetStream the type of the files whose content and extension are unknown.
+const OctetStream = "application/octet-stream"
+
+// extensionTypes the type of the lower case extensions missing from the mime package
+// table on some systems, consulted when the content is not recognized.
+var extensionTypes = map[string]string{
+	".7z":   "application/x-7z-compressed",
+	".bz2":  "application/x-bzip2",
+	".csv":  "text/csv",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".epub": "application/epub+zip",
+	".flac": "audio/flac",
+	".gz":   "application/gzip",
+	".heic": "image/heic",
+	".md":   "text/markdown",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".rar":  "application/vnd.rar",
+	".tar":  "application/x-tar",
+	".tgz":  "application/gzip",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".txt":  "text/plain",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xz":   "application/x-xz",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".zip":  "application/zip",
+	".zst":  "application/zstd",
+}
+
+// containerTypes the sniffed types the extension refines, plain text and zip
+// being the content of many formats.
+var containerTypes = map[string]bool{
+	OctetStream:       true,
+	"text/plain":      true,
+	"application/zip": true,
+}
+
+// DetectType returns the media type of the file name, without parameters. The type
+// is sniffed from the leading bytes of the file, the extension deciding when the
+// content is not recognized or is a container of several formats.
+func DetectType(name string) string {
+	sniffed := OctetStream
+	if f, err := os.Open(name); err == nil {
+		buf := make([]byte, sniffLen)
+		n, err := io.ReadFull(f, buf)
+		f.Close()
+		if n > 0 && (err == nil || err == io.EOF || err == io.ErrUnexpectedEOF) {
+			sniffed = mediaType(http.DetectContentType(buf[:n]))
+		}
+	}
+	if !containerTypes[sniffed] {
+		return sniffed
+	}
+	if t := ExtensionType(name); t != "" {
+		return t
+	}
+	return sniffed
+}
+
+// MediaType is the type of a file, detected once on first use so the checks and the
+// processor of a file share one read of its content.
+type MediaType struct {
+	name string
+	t    string
+}
+
+// NewMediaType returns the type of the file name, t when it is known already.
+func NewMediaType(name, t string) *MediaType {
+	return &MediaType{name: name, t: t}
+}
+
+// Get returns the type of the file, detecting it the first time.
+func (m *MediaType) Get() string {
+	if m.t == "" {
+		m.t = DetectType(m.name)
+	}
+	return m.t
+}
+
+// Known returns the type of the file when it was detected or given, empty otherwise.
+func (m *MediaType) Known() string {
+	return m.t
+}
+
+// ExtensionType returns the media type of the extension of name, whatever its case,
+// or an empty string when it is unknown.
+func ExtensionType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := extensionTypes[ext]; ok {
+		return t
+	}
+	return mediaType(mime.TypeByExtension(ext))
+}
+
+// MatchType reports whether the media type t matches one of rules, each written
+// as a type (application/pdf), a family (image/*) or * for all types.
+func MatchType(t string, rules []string) bool {
+	for _, rule := range rules {
+		rule = strings.ToLower(rule)
+		switch {
+		case rule == "*" || rule == "*/*":
+			return true
+		case strings.HasSuffix(rule, "/*"):
+			if strings.HasPrefix(t, strings.TrimSuffix(rule, "*")) {
+				return true
+			}
+		case rule == t:
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType strips the parameters of the content type v.
+func mediaType(v string) string {
+	if v == "" {
+		return ""
+	}
+	t, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.SplitN(v, ";", 2)[0]))
+	}
+	return t
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	jpegHeader = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	pdfHeader  = []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	zipHeader  = []byte("PK\x03\x04\x14\x00\x06\x00")
+	binary     = []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff}
+)
+
+func TestDetectType(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"image.txt", pngHeader, "image/png"},
+		{"report", pdfHeader, "application/pdf"},
+		{"PHOTO.JPG", jpegHeader, "image/jpeg"},
+		{"RAW.JPG", binary, "image/jpeg"},
+		{"letter.docx", zipHeader, "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"bundle.zip", zipHeader, "application/zip"},
+		{"unknown.zzz", zipHeader, "application/zip"},
+		{"notes", []byte("plain notes\n"), "text/plain"},
+		{"table.CSV", []byte("a,b\n1,2\n"), "text/csv"},
+		{"blob", binary, OctetStream},
+		{"empty.pdf", nil, "application/pdf"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(name, tt.content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if got := DetectType(name); got != tt.want {
+			t.Errorf("DetectType(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectTypeMissing(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "gone.png")
+	if got := DetectType(name); got != "image/png" {
+		t.Errorf("DetectType(missing png) = %q, want the type of its extension", got)
+	}
+}
+
+func TestExtensionType(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"a.jpg", "image/jpeg"},
+		{"A.JPG", "image/jpeg"},
+		{"a.Pdf", "application/pdf"},
+		{"a.tar.gz", "application/gzip"},
+		{"a.mkv", "video/x-matroska"},
+		{"noext", ""},
+		{"a.zzz", ""},
+	}
+	for _, tt := range tests {
+		if got := ExtensionType(tt.name); got != tt.want {
+			t.Errorf("ExtensionType(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchType(t *testing.T) {
+	tests := []struct {
+		t     string
+		rules []string
+		want  bool
+	}{
+		{"image/jpeg", []string{"image/*"}, true},
+		{"image/jpeg", []string{"image/jpeg"}, true},
+		{"image/jpeg", []string{"IMAGE/JPEG"}, true},
+		{"image/png", []string{"image/jpeg"}, false},
+		{"imagex/png", []string{"image/*"}, false},
+		{"application/pdf", []string{"image/*", "application/pdf"}, true},
+		{"video/mp4", []string{"image/*", "application/pdf"}, false},
+		{"video/mp4", []string{"*"}, true},
+		{"video/mp4", []string{"*/*"}, true},
+		{"video/mp4", nil, false},
+	}
+	for _, tt := range tests {
+		if got := MatchType(tt.t, tt.rules); got != tt.want {
+			t.Errorf("MatchType(%s, %v) = %v, want %v", tt.t, tt.rules, got, tt.want)
+		}
+	}
+}
+
+func TestMediaType(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "report")
+	if err := os.WriteFile(name, pdfHeader, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMediaType(name, "")
+	if m.Known() != "" {
+		t.Fatalf("Known() = %q before Get", m.Known())
+	}
+	if got := m.Get(); got != "application/pdf" {
+		t.Fatalf("Get() = %q", got)
+	}
+	if m.Known() != "application/pdf" {
+		t.Fatalf("Known() = %q after Get", m.Known())
+	}
+
+	// a known type is not read again
+	if got := NewMediaType(name, "image/png").Get(); got != "image/png" {
+		t.Fatalf("Get() of a known type = %q", got)
+	}
+}
@@ -22,11 +22,14 @@
 package utils
 
 import (
-	"github.com/hinha/watchgo/config"
 	"os"
 	"path"
-	"regexp"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/hinha/watchgo/config"
+	"github.com/hinha/watchgo/rules"
 )
 
 // allowedExtension a wordlist allowed extension.
@@ -76,13 +79,11 @@ var allowedExtension = []string{
 	"syntax", "yaml", "yaml-tmlanguage", "yang", "y", "yacc", "yy", "zep", "zimpl", "zmpl", "zpl", "desktop", "desktop.in", "ec", "eh", "edn", "fish", "mu", "nc", "ooc", "rst", "rest", "rest.txt", "rst.txt", "wisp", "prg", "ch", "prw", "conf", "shtml", "mhtml", "mht", "tmpl",
 }
 
-var (
-	ReExactPath, _ = regexp.Compile(`^(?:\/[^\/]+)+\/[^\/]+(\.[^.]+)$`)
-	// ReExactExt regex exact extension foo.abc.def.
-	ReExactExt = regexp.MustCompile(`\\.([A-Za-z0-9]{2,5}($|\\b\\?))`)
-)
-
 func init() {
+	// extensions are compared in lower case
+	for i, ext := range allowedExtension {
+		allowedExtension[i] = strings.ToLower(ext)
+	}
 	allowedExtension = removeDuplicate(allowedExtension)
 }
 func removeDuplicate[T string | int](sliceList []T) []T {
@@ -97,49 +98,63 @@ func removeDuplicate[T string | int](sliceList []T) []T {
 	return list
 }
 
-func IgnoreExtension(fullPath string) bool {
-	if len(config.FileSystemCfg.Backup.Prefix) != 0 {
-		for _, file := range config.FileSystemCfg.Backup.Prefix {
-			if file == "*" {
-				break
-			}
-			if strings.ToLower(path.Base(fullPath)) != file {
-				return false
-			}
-		}
-	}
-
-	stat, err := os.Stat(fullPath)
-	if err != nil {
-		return true
+// IgnoreFile reports whether the file name, the copy of source, is left out of the
+// backup. The prefix sets whether source is backed up before the ignore rules, the
+// last one matching it decides. A file no rule includes must then be of the types of
+// its watched path, or when none is configured be known from its content or from its
+// extension. stat is the FileInfo of source the size and age rules are checked
+// against, t the type of the content of name, only detected when needed.
+func IgnoreFile(name, source string, stat os.FileInfo, t *MediaType) bool {
+	prefix := config.FileSystemCfg.Backup.Prefix
+	types := config.FileSystemCfg.Backup.Types
+	var set rules.Set
+	var rel string
+	if p, ok := config.FileSystemCfg.Find(source); ok && source != p.Path {
+		prefix = p.GetPrefix()
+		types = p.GetTypes()
+		rel = relative(p, source)
+		set = ruleSet(p, rel)
 	}
 
-	if stat.IsDir() {
-		if strings.HasPrefix(stat.Name(), ".") {
-			return true
-		}
+	excluded := !hasPrefix(path.Base(filepath.ToSlash(source)), prefix)
+	if x, ok := set.Match(rel, stat, time.Now()); ok {
+		return x
 	}
-
-	if !ReExactPath.MatchString(fullPath) {
+	if excluded {
 		return true
 	}
 
-	exactExt := ReExactExt.FindString(fullPath)
-	if len(exactExt) == 0 {
-		return true
+	if len(types) > 0 {
+		return !MatchType(t.Get(), types)
+	}
+	if t.Get() != OctetStream {
+		return false
 	}
 
-	rExt := path.Ext(strings.ToLower(path.Base(exactExt)))
-	if len(rExt) == 0 {
+	ext := strings.ToLower(path.Ext(name))
+	if len(ext) < 2 {
 		return true
 	}
-
-	for _, ext := range allowedExtension {
-		excludes := rExt[1:]
-		if excludes == ext {
+	for _, allowed := range allowedExtension {
+		if ext[1:] == allowed {
 			return false
 		}
 	}
 
 	return true
 }
+
+// hasPrefix reports whether the lower case base name starts with one of prefix,
+// all names do when prefix is empty or holds *.
+func hasPrefix(base string, prefix []string) bool {
+	if len(prefix) == 0 {
+		return true
+	}
+	base = strings.ToLower(base)
+	for _, p := range prefix {
+		if p == "*" || strings.HasPrefix(base, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}